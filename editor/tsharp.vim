@@ -11,7 +11,7 @@ if exists("b:current_syntax")
 endif
 
 " Language keywords
-syntax keyword tsharpKeywords import block do end if else for int string bool type list
+syntax keyword tsharpKeywords import as export block do end if elif else match case default for in range break continue return try catch finally throw int string bool type list
 
 " Comments
 syntax region tsharpCommentLine start="//" end="$"   contains=tsharpTodos
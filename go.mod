@@ -2,4 +2,4 @@ module tsh
 
 go 1.16
 
-require github.com/fatih/color v1.13.0 // indirect
+require github.com/fatih/color v1.13.0
@@ -2,12 +2,31 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 	"os"
+	"net/url"
+	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
 	"github.com/fatih/color"
 )
 
@@ -44,6 +63,12 @@ const (
 	TOKEN_R_BRACKET
 	TOKEN_DOT
 	TOKEN_COMMA
+	TOKEN_LABEL
+	TOKEN_CATCH
+	TOKEN_FINALLY
+	TOKEN_ELIF
+	TOKEN_INTERP
+	TOKEN_COMMENT
 )
 
 var tokens = []string{
@@ -72,6 +97,12 @@ var tokens = []string{
 	TOKEN_R_BRACKET:      "TOKEN_R_BRACKET",
 	TOKEN_DOT:            "TOKEN_DOT",
 	TOKEN_COMMA:          "TOKEN_COMMA",
+	TOKEN_LABEL:          "TOKEN_LABEL",
+	TOKEN_CATCH:          "TOKEN_CATCH",
+	TOKEN_FINALLY:        "TOKEN_FINALLY",
+	TOKEN_ELIF:           "TOKEN_ELIF",
+	TOKEN_INTERP:         "TOKEN_INTERP",
+	TOKEN_COMMENT:        "TOKEN_COMMENT",
 }
 
 func (token Token) String() string {
@@ -81,11 +112,16 @@ func (token Token) String() string {
 type Position struct {
 	line int
 	column int
+	// file is the script the parser read, empty for the lexer.
+	file string
 }
 
 type Lexer struct {
 	pos Position
 	reader *bufio.Reader
+	// comments makes Lex return TOKEN_COMMENT instead of skipping
+	// comments, for tools that print the source back.
+	comments bool
 }
 
 func LexerInit(reader io.Reader) *Lexer {
@@ -120,72 +156,44 @@ func (lexer *Lexer) Lex() (Position, Token, string) {
 				if unicode.IsSpace(r) {
 					continue
 				} else if r == '=' {
-					r, _, err := lexer.reader.ReadRune()
-					if r == '\n' {break}
-					if err != nil {
-						panic(err)
-					}
-					lexer.pos.column++
-					if r == '=' {
-						return lexer.pos, TOKEN_IS_EQUALS, "=="
+					if lexer.accept('=') {
+						return tokenStart(lexer.pos, 1), TOKEN_IS_EQUALS, "=="
 					}
+					// a lone '=' is not a token and is skipped
+					continue
 				} else if r == '-' {
-					r, _, err := lexer.reader.ReadRune()
-					if r == '\n' {break}
-					if err != nil {
-						if err == io.EOF {
-							return lexer.pos, TOKEN_MINUS, "-"
-						}
-						panic(err)
-					}
-					lexer.pos.column++
-					if r == '>' {
-						return lexer.pos, TOKEN_EQUALS, "->"
-					} else {
-						return lexer.pos, TOKEN_MINUS, "-"
+					if lexer.accept('>') {
+						return tokenStart(lexer.pos, 1), TOKEN_EQUALS, "->"
 					}
+					return lexer.pos, TOKEN_MINUS, "-"
 				} else if r == '<' {
-					r, _, err := lexer.reader.ReadRune()
-					if err != nil {
-						if err == io.EOF {
-							return lexer.pos, TOKEN_LESS_THAN, "<"
-						}
-						panic(err)
-					}
-					if r == '=' {
-						lexer.pos.column++
-						return lexer.pos, TOKEN_LESS_EQUALS, "<="
-					} else {
-						return lexer.pos, TOKEN_LESS_THAN, "<"
+					if lexer.accept('=') {
+						return tokenStart(lexer.pos, 1), TOKEN_LESS_EQUALS, "<="
 					}
+					return lexer.pos, TOKEN_LESS_THAN, "<"
 				} else if r == '>' {
-					r, _, err := lexer.reader.ReadRune()
-					if err != nil {
-						if err == io.EOF {
-							return lexer.pos, TOKEN_GREATER_THAN, ">"
-						}
-						panic(err)
-					}
-					if r == '=' {
-						lexer.pos.column++
-						return lexer.pos, TOKEN_GREATER_EQUALS, ">="
-					} else {
-						return lexer.pos, TOKEN_GREATER_THAN, ">"
+					if lexer.accept('=') {
+						return tokenStart(lexer.pos, 1), TOKEN_GREATER_EQUALS, ">="
 					}
+					return lexer.pos, TOKEN_GREATER_THAN, ">"
 				} else if r == '!' {
-					r, _, err := lexer.reader.ReadRune()
-					if r == '\n' {break}
-					if err != nil {panic(err)}
-					lexer.pos.column++
-					if r == '=' {
-						return lexer.pos, TOKEN_NOT_EQUALS, "!="
+					if lexer.accept('=') {
+						return tokenStart(lexer.pos, 1), TOKEN_NOT_EQUALS, "!="
+					}
+					// a lone '!' is not a token and is skipped
+					continue
+				} else if r == ':' {
+					startPos := lexer.pos
+					val := lexer.lexId()
+					if val == "" {
+						return startPos, TOKEN_ILLEGAL, ":"
 					}
+					return startPos, TOKEN_LABEL, val
 				} else if r == '#' {
-					for {
-						r, _, err := lexer.reader.ReadRune()
-						if r == '\n' {break}
-						if err != nil {panic(err)}
-						lexer.pos.column++
+					startPos := lexer.pos
+					val := lexer.lexComment()
+					if lexer.comments {
+						return startPos, TOKEN_COMMENT, val
 					}
 					continue
 				} else if unicode.IsDigit(r) {
@@ -193,7 +201,7 @@ func (lexer *Lexer) Lex() (Position, Token, string) {
 					lexer.backup()
 					val := lexer.lexInt()
 					return startPos, TOKEN_INT, val
-				} else if unicode.IsLetter(r) {
+				} else if unicode.IsLetter(r) || r == '_' {
 					startPos := lexer.pos
 					lexer.backup()
 					val := lexer.lexId()
@@ -207,19 +215,100 @@ func (lexer *Lexer) Lex() (Position, Token, string) {
 						return startPos, TOKEN_TYPE, val
 					} else if val == "else" {
 						return startPos, TOKEN_ELSE, val
+					} else if val == "elif" {
+						return startPos, TOKEN_ELIF, val
+					} else if val == "catch" {
+						return startPos, TOKEN_CATCH, val
+					} else if val == "finally" {
+						return startPos, TOKEN_FINALLY, val
 					}
 					return startPos, TOKEN_ID, val
 				} else if r == '"' {
 					startPos := lexer.pos
 					lexer.backup()
 					val := lexer.lexString()
-					r, _, err = lexer.reader.ReadRune()
+					lexer.reader.ReadRune()
+					lexer.pos.column++
 					return startPos, TOKEN_STRING, val
+				} else if r == '$' {
+					startPos := lexer.pos
+					if !lexer.accept('"') {
+						return startPos, TOKEN_ILLEGAL, "$"
+					}
+					lexer.backup()
+					val := lexer.lexString()
+					lexer.reader.ReadRune()
+					lexer.pos.column++
+					return startPos, TOKEN_INTERP, val
 				}
         }
 	}
 }
 
+// accept consumes the next rune if it is want.
+func (lexer *Lexer) accept(want rune) bool {
+	r, _, err := lexer.reader.ReadRune()
+	if err != nil {
+		return false
+	}
+	if r != want {
+		lexer.reader.UnreadRune()
+		return false
+	}
+	lexer.pos.column++
+	return true
+}
+
+// markedWord reports whether name is one of the words spelled with '-'
+// or '?', such as 'and-then', 'read-all' and 'eof?'. Only these are
+// lexed as one name; anywhere else '-' and '?' end the name.
+func markedWord(name string) bool {
+	if !strings.ContainsAny(name, "-?") {
+		return false
+	}
+	if _, ok := Builtins[name]; ok {
+		return true
+	}
+	for _, keyword := range Keywords {
+		if keyword == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lexMarked extends the name val with the '-' and '?' parts that follow
+// it when that spells a marked word, taking the longest one that is not
+// itself followed by more of a name.
+func (lexer *Lexer) lexMarked(val string) string {
+	b, _ := lexer.reader.Peek(64)
+	rest := []rune(string(b))
+	name, best, width := val, val, 0
+	for i, r := range rest {
+		if !(unicode.IsLetter(r) || r == '_' || r == '?' || r == '-') {
+			break
+		}
+		name += string(r)
+		if i+1 < len(rest) && (unicode.IsLetter(rest[i+1]) || rest[i+1] == '_' || rest[i+1] == '?') {
+			continue
+		}
+		if markedWord(name) {
+			best, width = name, i+1
+		}
+	}
+	for n := 0; n < width; n++ {
+		lexer.reader.ReadRune()
+		lexer.pos.column++
+	}
+	return best
+}
+
+// tokenStart is the position of the first rune of a token that ends at pos.
+func tokenStart(pos Position, width int) Position {
+	pos.column -= width
+	return pos
+}
+
 func (lexer *Lexer) backup() {
 	if err := lexer.reader.UnreadRune(); err != nil {
 		panic(err)
@@ -237,10 +326,13 @@ func (lexer *Lexer) lexId() string {
 			}
 		}
         lexer.pos.column++
-		if unicode.IsLetter(r) {
+		if unicode.IsLetter(r) || r == '_' {
 			val = val + string(r)
 		} else {
 			lexer.backup()
+			if r == '-' || r == '?' {
+				return lexer.lexMarked(val)
+			}
 			return val
 		}
 	}
@@ -265,9 +357,28 @@ func (lexer *Lexer) lexInt() string {
 	}
 }
 
+// lexComment reads the rest of the line after '#', leaving the
+// newline for Lex to count.
+func (lexer *Lexer) lexComment() string {
+	var val string
+	for {
+		r, _, err := lexer.reader.ReadRune()
+		if err != nil {
+			return val
+		}
+		if r == '\n' {
+			lexer.reader.UnreadRune()
+			return val
+		}
+		lexer.pos.column++
+		val = val + string(r)
+	}
+}
+
 func (lexer *Lexer) lexString() string {
 	var val string
 	r, _, err := lexer.reader.ReadRune()
+	lexer.pos.column++
 	for {
 		r, _, err = lexer.reader.ReadRune()
 		if err != nil {
@@ -276,6 +387,9 @@ func (lexer *Lexer) lexString() string {
 			}
 		}
 		lexer.pos.column++
+		if r == '\n' {
+			lexer.resetPosition()
+		}
 		if r != '"' {
 			val = val + string(r)
 		} else {
@@ -300,6 +414,7 @@ const (
 	ExprVoid ExprType = iota
 	ExprInt
 	ExprStr
+	ExprInterp
 	ExprId
 	ExprArr
 	ExprAppend
@@ -318,15 +433,26 @@ const (
 	ExprLen
 	ExprTypeOf
 	ExprBreak
+	ExprContinue
+	ExprReturn
+	ExprTry
+	ExprThrow
 	ExprSwap
 	ExprImport
 	ExprCall
 	ExprBool
 	ExprIf
+	ExprMatch
 	ExprDup
 	ExprDrop
 	ExprExit
+	ExprExitWith
 	ExprFor	
+	ExprForIn
+	ExprRange
+	ExprBuiltin
+	ExprAndThen
+	ExprOrElse
 	ExprBinop // + - * / %
 	ExprCompare // < > == !=
 	ExprVardef
@@ -348,30 +474,69 @@ type Expr struct {
 	AsFor *For
 	AsBiniop int
 	AsCompare int
-	AsImport string
+	AsImport *Import
 	AsVardef *Vardef
+	AsLabel string
+	AsTry *Try
+	AsMatch *Match
+	AsBuiltin string
+	AsBody []Expr
+	Pos Position
 }
 
 type Push struct {
 	Arg Expr
 }
 
+type Import struct {
+	Path string
+	Alias string
+	From string
+}
+
 type Call struct {
+	Module string
 	Value string
 }
 
 type Blockdef struct {
 	Name string
 	Body []Expr
+	Exported bool
 }
 
 type If struct {
 	Op []Expr
 	Body []Expr
+	Elifs []Elif
 	ElseBody []Expr
 }
 
+type Elif struct {
+	Op []Expr
+	Body []Expr
+}
+
+type Match struct {
+	Op []Expr
+	Cases []Case
+	Default []Expr
+}
+
+type Case struct {
+	Pattern Expr
+	Body []Expr
+}
+
+type Try struct {
+	Body []Expr
+	CatchBody []Expr
+	FinallyBody []Expr
+}
+
 type For struct {
+	Label string
+	Var string
 	Op []Expr
 	Body []Expr
 }
@@ -400,6 +565,13 @@ type Parser struct {
 	lexer Lexer
 	line int
 	column int
+	labels []string
+	loops int
+	peeked bool
+	peek_pos Position
+	peek_token_type Token
+	peek_token_value string
+	file string
 }
 
 func ParserInit(lexer *Lexer) *Parser {
@@ -415,18 +587,70 @@ func ParserInit(lexer *Lexer) *Parser {
 
 func (parser *Parser) ParserEat(token Token) {
 	if token != parser.current_token_type {
-		fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: unexpected token value '%s'", parser.line, parser.column, parser.current_token_value))
-		os.Exit(0)
+		parser.SyntaxError(fmt.Sprintf("unexpected token value '%s'", parser.current_token_value))
+	}
+	var pos Position
+	var tok Token
+	var val string
+	if parser.peeked {
+		pos, tok, val = parser.peek_pos, parser.peek_token_type, parser.peek_token_value
+		parser.peeked = false
+	} else {
+		pos, tok, val = parser.lexer.Lex()
 	}
-	pos, tok, val := parser.lexer.Lex()
 	parser.current_token_type = tok
 	parser.current_token_value = val
 	parser.line = pos.line
 	parser.column = pos.column
 }
 
-// just so you can call it later 
-// like in a type cast or input
+// ParserPeek returns the token after the current one without eating
+// anything.
+func (parser *Parser) ParserPeek() (Token, string) {
+	if !parser.peeked {
+		parser.peek_pos, parser.peek_token_type, parser.peek_token_value = parser.lexer.Lex()
+		parser.peeked = true
+	}
+	return parser.peek_token_type, parser.peek_token_value
+}
+
+// ParserLabel eats the optional ':label' after 'break' or 'continue'
+// and checks that it names an enclosing for loop.
+func (parser *Parser) ParserLabel() string {
+	if parser.current_token_type != TOKEN_LABEL {
+		return ""
+	}
+	label := parser.current_token_value
+	for i := len(parser.labels)-1; i >= 0; i-- {
+		if parser.labels[i] == label {
+			parser.ParserEat(TOKEN_LABEL)
+			return label
+		}
+	}
+	parser.SyntaxError(fmt.Sprintf("undefined loop label ':%s'", label))
+	return ""
+}
+
+// variableName returns the current token as the name of a variable.
+// The words of the language are reserved: a variable named like one
+// could never be read back.
+func (parser *Parser) variableName() string {
+	name := parser.current_token_value
+	if parser.current_token_type == TOKEN_ID && isWord(name) {
+		parser.SyntaxError(fmt.Sprintf("cannot use the reserved word '%s' as a variable", name))
+	}
+	return name
+}
+
+func (parser *Parser) SyntaxError(message string) {
+	panic(&Exception{
+		Kind: "SyntaxError",
+		Message: message,
+		Pos: Position{line: parser.line, column: parser.column},
+	})
+}
+
+// isInt reports whether num can be converted with StrToInt.
 func isInt(num string) bool {
 	_, err := strconv.Atoi(num)
 	return err == nil
@@ -457,6 +681,10 @@ func ParserParseExpr(parser *Parser) (Expr) {
 			expr.Type = ExprStr
 			expr.AsStr = parser.current_token_value
 			parser.ParserEat(TOKEN_STRING)
+		case TOKEN_INTERP:
+			expr.Type = ExprInterp
+			expr.AsStr = parser.current_token_value
+			parser.ParserEat(TOKEN_INTERP)
 		case TOKEN_BOOL:
 			expr.Type = ExprBool
 			if parser.current_token_value == "true" {
@@ -508,8 +736,7 @@ func ParserParseExpr(parser *Parser) (Expr) {
 			}
 			parser.ParserEat(TOKEN_R_BRACKET)
 		default:
-			fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: unexpected token value '%s'", parser.line, parser.column, parser.current_token_value))
-			os.Exit(0)
+			parser.SyntaxError(fmt.Sprintf("unexpected token value '%s'", parser.current_token_value))
 	}
 	return expr
 }
@@ -519,6 +746,7 @@ func ParserParse(parser *Parser)  ([]Expr, Parser) {
 
 	for {
 		expr := Expr{}
+		expr.Pos = Position{line: parser.line, column: parser.column, file: parser.file}
 		if parser.current_token_type == TOKEN_ID {
 			if parser.current_token_value == "print" {
 				parser.ParserEat(TOKEN_ID)
@@ -571,12 +799,44 @@ func ParserParse(parser *Parser)  ([]Expr, Parser) {
 			} else if parser.current_token_value == "import" {
 				parser.ParserEat(TOKEN_ID)
 				if parser.current_token_type != TOKEN_STRING {
-					fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: unexpected token value '%s'", parser.line, parser.column, parser.current_token_value))
-					os.Exit(0)
+					parser.SyntaxError(fmt.Sprintf("unexpected token value '%s'", parser.current_token_value))
 				}
 				expr.Type = ExprImport
-				expr.AsImport = parser.current_token_value
+				expr.AsImport = &Import{
+					Path: parser.current_token_value,
+					From: parser.file,
+				}
 				parser.ParserEat(TOKEN_STRING)
+				if parser.current_token_type == TOKEN_ID && parser.current_token_value == "as" {
+					parser.ParserEat(TOKEN_ID)
+					if parser.current_token_type != TOKEN_ID {
+						parser.SyntaxError(fmt.Sprintf("unexpected token value '%s'", parser.current_token_value))
+					}
+					expr.AsImport.Alias = parser.current_token_value
+					parser.ParserEat(TOKEN_ID)
+				}
+				exprs = append(exprs, expr)
+			} else if parser.current_token_value == "and-then" || parser.current_token_value == "or-else" {
+				word := parser.current_token_value
+				parser.ParserEat(TOKEN_ID)
+				expr.Type = ExprAndThen
+				if word == "or-else" {
+					expr.Type = ExprOrElse
+				}
+				if parser.current_token_type == TOKEN_END {
+					parser.SyntaxError(fmt.Sprintf("'%s' body is empty", word))
+				}
+				expr.AsBody, _ = ParserParse(parser)
+				parser.ParserEat(TOKEN_END)
+				exprs = append(exprs, expr)
+			} else if _, ok := Builtins[parser.current_token_value]; ok {
+				expr.Type = ExprBuiltin
+				expr.AsBuiltin = parser.current_token_value
+				parser.ParserEat(TOKEN_ID)
+				exprs = append(exprs, expr)
+			} else if parser.current_token_value == "range" {
+				parser.ParserEat(TOKEN_ID)
+				expr.Type = ExprRange
 				exprs = append(exprs, expr)
 			} else if parser.current_token_value == "dup" {
 				parser.ParserEat(TOKEN_ID)
@@ -590,39 +850,72 @@ func ParserParse(parser *Parser)  ([]Expr, Parser) {
 				parser.ParserEat(TOKEN_ID)
 				expr.Type = ExprExit
 				exprs = append(exprs, expr)
-			} else if parser.current_token_value == "block" {
+			} else if parser.current_token_value == "exit-with" {
+				parser.ParserEat(TOKEN_ID)
+				expr.Type = ExprExitWith
+				exprs = append(exprs, expr)
+			} else if parser.current_token_value == "block" || parser.current_token_value == "export" {
+				exported := false
+				if parser.current_token_value == "export" {
+					parser.ParserEat(TOKEN_ID)
+					if parser.current_token_type != TOKEN_ID || parser.current_token_value != "block" {
+						parser.SyntaxError(fmt.Sprintf("'export' expected 'block' but got '%s'", parser.current_token_value))
+					}
+					exported = true
+				}
 				parser.ParserEat(TOKEN_ID)
 				expr.Type = ExprBlockdef
 				if parser.current_token_type != TOKEN_ID {
-					fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: unexpected token value '%s'", parser.line, parser.column, parser.current_token_value))
-					os.Exit(0)
+					parser.SyntaxError(fmt.Sprintf("unexpected token value '%s'", parser.current_token_value))
 				}
 				name := parser.current_token_value
 				parser.ParserEat(TOKEN_ID)
 				parser.ParserEat(TOKEN_DO)
 				if parser.current_token_type == TOKEN_END {
-					fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: block '%s' body is empty", parser.line, parser.column, name))
-					os.Exit(0)
+					parser.SyntaxError(fmt.Sprintf("block '%s' body is empty", name))
 				}
+				labels, loops := parser.labels, parser.loops
+				parser.labels, parser.loops = nil, 0
 				body, _ := ParserParse(parser)
+				parser.labels, parser.loops = labels, loops
 				expr.AsBlockdef = &Blockdef{
 					Name: name,
 					Body: body,
+					Exported: exported,
 				}
 				parser.ParserEat(TOKEN_END)
 				exprs = append(exprs, expr)
 			} else if parser.current_token_value == "for" {
 				parser.ParserEat(TOKEN_ID)
 				expr.Type = ExprFor
+				var label string
+				if parser.current_token_type == TOKEN_LABEL {
+					label = parser.current_token_value
+					parser.ParserEat(TOKEN_LABEL)
+				}
+				var name string
+				if parser.current_token_type == TOKEN_ID {
+					if tok, val := parser.ParserPeek(); tok == TOKEN_ID && val == "in" {
+						expr.Type = ExprForIn
+						name = parser.variableName()
+						parser.ParserEat(TOKEN_ID)
+						parser.ParserEat(TOKEN_ID)
+					}
+				}
 				op, _ := ParserParse(parser)
 				parser.ParserEat(TOKEN_DO)
 				if parser.current_token_type == TOKEN_END {
-					fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: for loop body is empty", parser.line, parser.column))
-					os.Exit(0)
+					parser.SyntaxError("for loop body is empty")
 				}
+				parser.labels = append(parser.labels, label)
+				parser.loops++
 				body, _ := ParserParse(parser)
+				parser.loops--
+				parser.labels = parser.labels[:len(parser.labels)-1]
 				parser.ParserEat(TOKEN_END)
 				expr.AsFor = &For{
+					Label: label,
+					Var: name,
 					Op: op,
 					Body: body,
 				}
@@ -632,48 +925,134 @@ func ParserParse(parser *Parser)  ([]Expr, Parser) {
 				expr.Type = ExprIf
 				op, _ := ParserParse(parser)
 				parser.ParserEat(TOKEN_DO)
-				if parser.current_token_type == TOKEN_ELSE || parser.current_token_type == TOKEN_END {
-					fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: if statement body is empty", parser.line, parser.column))
-					os.Exit(0)
+				if parser.current_token_type == TOKEN_ELSE || parser.current_token_type == TOKEN_ELIF || parser.current_token_type == TOKEN_END {
+					parser.SyntaxError("if statement body is empty")
 				}
 				body, _ := ParserParse(parser)
+				expr.AsIf = &If{
+					Op: op,
+					Body: body,
+				}
+				for parser.current_token_type == TOKEN_ELIF {
+					parser.ParserEat(TOKEN_ELIF)
+					elifOp, _ := ParserParse(parser)
+					parser.ParserEat(TOKEN_DO)
+					if parser.current_token_type == TOKEN_ELSE || parser.current_token_type == TOKEN_ELIF || parser.current_token_type == TOKEN_END {
+						parser.SyntaxError("elif body is empty")
+					}
+					elifBody, _ := ParserParse(parser)
+					expr.AsIf.Elifs = append(expr.AsIf.Elifs, Elif{
+						Op: elifOp,
+						Body: elifBody,
+					})
+				}
 				if parser.current_token_type == TOKEN_ELSE {
 					parser.ParserEat(TOKEN_ELSE)
-					if parser.current_token_type == TOKEN_ELSE || parser.current_token_type == TOKEN_END {
-						fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: if statement body is empty", parser.line, parser.column))
-						os.Exit(0)
+					if parser.current_token_type == TOKEN_ELSE || parser.current_token_type == TOKEN_ELIF || parser.current_token_type == TOKEN_END {
+						parser.SyntaxError("if statement body is empty")
 					}
 					ElseBody, _ := ParserParse(parser)
+					expr.AsIf.ElseBody = ElseBody
+				}
+				parser.ParserEat(TOKEN_END)
+				exprs = append(exprs, expr)
+			} else if parser.current_token_value == "match" {
+				parser.ParserEat(TOKEN_ID)
+				expr.Type = ExprMatch
+				op, _ := ParserParse(parser)
+				parser.ParserEat(TOKEN_DO)
+				expr.AsMatch = &Match{
+					Op: op,
+				}
+				for parser.current_token_type == TOKEN_ID && parser.current_token_value == "case" {
+					parser.ParserEat(TOKEN_ID)
+					pattern := ParserParseExpr(parser)
+					parser.ParserEat(TOKEN_DO)
+					body, _ := ParserParse(parser)
 					parser.ParserEat(TOKEN_END)
-					expr.AsIf = &If{
-						Op: op,
+					expr.AsMatch.Cases = append(expr.AsMatch.Cases, Case{
+						Pattern: pattern,
 						Body: body,
-						ElseBody: ElseBody,
-					}
-					exprs = append(exprs, expr)
-				} else {
+					})
+				}
+				if parser.current_token_type == TOKEN_ID && parser.current_token_value == "default" {
+					parser.ParserEat(TOKEN_ID)
+					parser.ParserEat(TOKEN_DO)
+					body, _ := ParserParse(parser)
 					parser.ParserEat(TOKEN_END)
-					expr.AsIf = &If{
-						Op: op,
-						Body: body,
-					}
-					exprs = append(exprs, expr)
+					expr.AsMatch.Default = body
 				}
+				if parser.current_token_type != TOKEN_END {
+					parser.SyntaxError(fmt.Sprintf("match expected 'case', 'default' or 'end' but got '%s'", parser.current_token_value))
+				}
+				parser.ParserEat(TOKEN_END)
+				exprs = append(exprs, expr)
 			} else if parser.current_token_value == "call" {
 				parser.ParserEat(TOKEN_ID)
 				if parser.current_token_type != TOKEN_ID {
-					fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: unexpected token value '%s'", parser.line, parser.column, parser.current_token_value))
-					os.Exit(0)
+					parser.SyntaxError(fmt.Sprintf("unexpected token value '%s'", parser.current_token_value))
 				}
 				expr.Type = ExprCall
 				expr.AsCall = &Call{
 					Value: parser.current_token_value,
 				}
 				parser.ParserEat(TOKEN_ID)
+				if parser.current_token_type == TOKEN_DOT {
+					parser.ParserEat(TOKEN_DOT)
+					if parser.current_token_type != TOKEN_ID {
+						parser.SyntaxError(fmt.Sprintf("unexpected token value '%s'", parser.current_token_value))
+					}
+					expr.AsCall.Module = expr.AsCall.Value
+					expr.AsCall.Value = parser.current_token_value
+					parser.ParserEat(TOKEN_ID)
+				}
 				exprs = append(exprs, expr)
 			} else if parser.current_token_value == "break" {
+				if parser.loops == 0 {
+					parser.SyntaxError("'break' outside of a for loop")
+				}
 				parser.ParserEat(TOKEN_ID)
 				expr.Type = ExprBreak
+				expr.AsLabel = parser.ParserLabel()
+				exprs = append(exprs, expr)
+			} else if parser.current_token_value == "continue" {
+				if parser.loops == 0 {
+					parser.SyntaxError("'continue' outside of a for loop")
+				}
+				parser.ParserEat(TOKEN_ID)
+				expr.Type = ExprContinue
+				expr.AsLabel = parser.ParserLabel()
+				exprs = append(exprs, expr)
+			} else if parser.current_token_value == "try" {
+				parser.ParserEat(TOKEN_ID)
+				expr.Type = ExprTry
+				if parser.current_token_type == TOKEN_CATCH || parser.current_token_type == TOKEN_FINALLY || parser.current_token_type == TOKEN_END {
+					parser.SyntaxError("try body is empty")
+				}
+				body, _ := ParserParse(parser)
+				expr.AsTry = &Try{
+					Body: body,
+				}
+				if parser.current_token_type != TOKEN_CATCH && parser.current_token_type != TOKEN_FINALLY {
+					parser.SyntaxError("try expected 'catch' or 'finally'")
+				}
+				if parser.current_token_type == TOKEN_CATCH {
+					parser.ParserEat(TOKEN_CATCH)
+					expr.AsTry.CatchBody, _ = ParserParse(parser)
+				}
+				if parser.current_token_type == TOKEN_FINALLY {
+					parser.ParserEat(TOKEN_FINALLY)
+					expr.AsTry.FinallyBody, _ = ParserParse(parser)
+				}
+				parser.ParserEat(TOKEN_END)
+				exprs = append(exprs, expr)
+			} else if parser.current_token_value == "throw" {
+				parser.ParserEat(TOKEN_ID)
+				expr.Type = ExprThrow
+				exprs = append(exprs, expr)
+			} else if parser.current_token_value == "return" {
+				parser.ParserEat(TOKEN_ID)
+				expr.Type = ExprReturn
 				exprs = append(exprs, expr)
 			} else if parser.current_token_value == "append" {
 				parser.ParserEat(TOKEN_ID)
@@ -760,27 +1139,141 @@ func ParserParse(parser *Parser)  ([]Expr, Parser) {
 			exprs = append(exprs, expr)
 		} else if parser.current_token_type == TOKEN_EQUALS {
 			parser.ParserEat(TOKEN_EQUALS)
+			parser.variableName()
 			expr.Type = ExprVardef
 			expr.AsVardef = &Vardef {
 				Name: parser.current_token_value,
 			}
 			parser.ParserEat(TOKEN_ID)
 			exprs = append(exprs, expr)
-		} else if parser.current_token_type == TOKEN_INT || parser.current_token_type == TOKEN_STRING || parser.current_token_type == TOKEN_L_BRACKET || parser.current_token_type == TOKEN_TYPE || parser.current_token_type == TOKEN_BOOL {
+		} else if parser.current_token_type == TOKEN_INT || parser.current_token_type == TOKEN_STRING || parser.current_token_type == TOKEN_INTERP || parser.current_token_type == TOKEN_L_BRACKET || parser.current_token_type == TOKEN_TYPE || parser.current_token_type == TOKEN_BOOL {
 			expr.Type = ExprPush
 			expr.AsPush = &Push{
 				Arg: ParserParseExpr(parser),
 			}
 			exprs = append(exprs, expr)
-		} else if parser.current_token_type == TOKEN_END || parser.current_token_type == TOKEN_ELSE || parser.current_token_type == TOKEN_DO || parser.current_token_type == TOKEN_EOF {
+		} else if parser.current_token_type == TOKEN_END || parser.current_token_type == TOKEN_ELSE || parser.current_token_type == TOKEN_ELIF || parser.current_token_type == TOKEN_DO || parser.current_token_type == TOKEN_CATCH || parser.current_token_type == TOKEN_FINALLY || parser.current_token_type == TOKEN_EOF {
 			return exprs, *parser
 		} else {
-			fmt.Println(fmt.Sprintf("SyntaxError:%d:%d: unexpected token value '%s'", parser.line, parser.column, parser.current_token_value))
-			os.Exit(0)
+			parser.SyntaxError(fmt.Sprintf("unexpected token value '%s'", parser.current_token_value))
+		}
+	}
+}
+
+
+// -----------------------------
+// ----------- Error -----------
+// -----------------------------
+
+// Exception is raised by the interpreter, the parser and 'throw'. It
+// unwinds the Go stack with panic up to the nearest 'try' or to main.
+type Exception struct {
+	Kind string
+	Message string
+	Pos Position
+}
+
+// Error formats the exception as Kind:line:column: message. An error
+// in a file other than the main script names the file after the kind.
+func (exception *Exception) Error() string {
+	if file := exception.Pos.file; file != "" && file != MainScript {
+		if !strings.HasPrefix(file, "std/") {
+			file = DisplayPath(file)
+		}
+		return fmt.Sprintf("%s:%s:%d:%d: %s", exception.Kind, file, exception.Pos.line, exception.Pos.column, exception.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", exception.Kind, exception.Pos.line, exception.Pos.column, exception.Message)
+}
+
+// CurrentPos is the position of the expression being visited.
+var CurrentPos Position
+
+func Raise(kind string, message string) {
+	panic(&Exception{
+		Kind: kind,
+		Message: message,
+		Pos: CurrentPos,
+	})
+}
+
+// ExceptionExpr is the value pushed for the catch body:
+// [kind, message, line, column]
+func ExceptionExpr(exception *Exception) Expr {
+	expr := Expr{}
+	expr.Type = ExprArr
+	expr.AsArr = []Expr{
+		{Type: ExprStr, AsStr: exception.Kind},
+		{Type: ExprStr, AsStr: exception.Message},
+		{Type: ExprInt, AsInt: exception.Pos.line},
+		{Type: ExprInt, AsInt: exception.Pos.column},
+	}
+	return expr
+}
+
+// VisitGuarded visits exprs and hands back the exception that stopped
+// them, if any. Anything that is not an Exception keeps unwinding.
+func VisitGuarded(exprs []Expr) (control Control, exception *Exception) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if exception, ok = r.(*Exception); !ok {
+				panic(r)
+			}
+		}
+	}()
+	return VisitExpr(exprs), nil
+}
+
+// OpTry runs the try body. On an exception the stack is cut back to
+// its depth at 'try', the error value is pushed and the catch body
+// runs. The finally body always runs last; a break, continue or return
+// in it wins over whatever the other bodies did.
+func OpTry(expr Expr) (Control) {
+	depth := len(Stack)
+	control, exception := VisitGuarded(expr.AsTry.Body)
+	if exception != nil && expr.AsTry.CatchBody != nil {
+		if len(Stack) > depth {
+			Stack = Stack[:depth]
+		}
+		OpPush(ExceptionExpr(exception))
+		control, exception = VisitGuarded(expr.AsTry.CatchBody)
+	}
+	if expr.AsTry.FinallyBody != nil {
+		finallyControl := VisitExpr(expr.AsTry.FinallyBody)
+		if finallyControl.Kind != ControlNone {
+			return finallyControl
 		}
 	}
+	if exception != nil {
+		panic(exception)
+	}
+	return control
+}
 
-	return exprs, *parser
+// OpThrow raises the top of the stack. A string is thrown as an
+// 'Error'; a list starting with two strings gives the kind and message,
+// so a caught error value can be thrown again unchanged.
+func OpThrow() {
+	if len(Stack) < 1 {
+		Raise("StackError", "'throw' expected more than one element in stack.")
+	}
+	visitedExpr := Stack[len(Stack)-1]
+	OpDrop()
+	if visitedExpr.Type == ExprStr {
+		Raise("Error", visitedExpr.AsStr)
+	}
+	if visitedExpr.Type != ExprArr || len(visitedExpr.AsArr) < 2 || visitedExpr.AsArr[0].Type != ExprStr || visitedExpr.AsArr[1].Type != ExprStr {
+		Raise("TypeError", "'throw' expected type <string> or [<string>, <string>]")
+	}
+	exception := &Exception{
+		Kind: visitedExpr.AsArr[0].AsStr,
+		Message: visitedExpr.AsArr[1].AsStr,
+		Pos: CurrentPos,
+	}
+	if len(visitedExpr.AsArr) == 4 && visitedExpr.AsArr[2].Type == ExprInt && visitedExpr.AsArr[3].Type == ExprInt {
+		exception.Pos = Position{line: visitedExpr.AsArr[2].AsInt, column: visitedExpr.AsArr[3].AsInt}
+	}
+	panic(exception)
 }
 
 
@@ -795,7 +1288,7 @@ func VisitVar(VarName string, expr Expr) (Expr) {
 	if _, ok := VariableScope[VarName]; ok {
 		VisitedVar = VariableScope[VarName]
 	} else {
-		fmt.Println("Error: undefined variable '" + VarName + "'"); os.Exit(0);
+		Raise("NameError", "undefined variable '" + VarName + "'")
 	}
 	if expr.AsId.Index != nil {
 		var VisitedListValue *Expr
@@ -806,16 +1299,25 @@ func VisitVar(VarName string, expr Expr) (Expr) {
 				var VarExpr Expr
 				VarExpr = VisitVar(expr.AsId.Index[i].AsId.Name, expr.AsId.Index[i])
 				if VarExpr.Type != ExprInt {
-					fmt.Println("TypeError: list index must be type <int>"); os.Exit(0);
+					Raise("TypeError", "list index must be type <int>")
 				}
 				IntValue = VarExpr.AsInt
 			} else if expr.AsId.Index[i].Type != ExprInt {
-				fmt.Println("TypeError: list index must be type <int>"); os.Exit(0);
+				Raise("TypeError", "list index must be type <int>")
 			} else {
 				IntValue = expr.AsId.Index[i].AsInt
 			}
-			if len(VisitedListValue.AsArr) <= IntValue {
-				fmt.Println("Error: index out of range"); os.Exit(0);
+			if VisitedListValue.Type == ExprStr {
+				// strings are indexed by rune, not by byte
+				runes := []rune(VisitedListValue.AsStr)
+				if IntValue < 0 || IntValue >= len(runes) {
+					Raise("IndexError", "string index out of range")
+				}
+				VisitedListValue = &Expr{Type: ExprStr, AsStr: string(runes[IntValue])}
+				continue
+			}
+			if IntValue < 0 || IntValue >= len(VisitedListValue.AsArr) {
+				Raise("IndexError", "index out of range")
 			}
 			VisitedListValue = &VisitedListValue.AsArr[IntValue]
 		}
@@ -835,6 +1337,8 @@ func OpBuildArr(exprs []Expr)Expr {
 		} else if exprs[i].Type == ExprArr {
 			exprArr := OpBuildArr(exprs[i].AsArr)
 			arrExprs = append(arrExprs, exprArr)
+		} else if exprs[i].Type == ExprInterp {
+			arrExprs = append(arrExprs, Expr{Type: ExprStr, AsStr: Format(exprs[i].AsStr, nil)})
 		} else {
 			arrExprs = append(arrExprs, exprs[i])
 		}
@@ -846,6 +1350,8 @@ func OpBuildArr(exprs []Expr)Expr {
 func OpPush(item Expr) {
 	if item.Type == ExprId {
 		item = VisitVar(item.AsId.Name, item)
+	} else if item.Type == ExprInterp {
+		item = Expr{Type: ExprStr, AsStr: Format(item.AsStr, nil)}
 	} else if  item.Type == ExprArr {
 		expr := Expr{}
 		expr.Type = ExprArr
@@ -857,6 +1363,8 @@ func OpPush(item Expr) {
 			} else if item.AsArr[i].Type == ExprArr {
 				exprArr := OpBuildArr(item.AsArr[i].AsArr)
 				arrExprs = append(arrExprs, exprArr)
+			} else if item.AsArr[i].Type == ExprInterp {
+				arrExprs = append(arrExprs, Expr{Type: ExprStr, AsStr: Format(item.AsArr[i].AsStr, nil)})
 			} else {
 				arrExprs = append(arrExprs, item.AsArr[i])
 			}
@@ -870,8 +1378,7 @@ func OpPush(item Expr) {
 
 func OpDrop() {
 	if len(Stack)-1 < 0 {
-		fmt.Println("DropError: the stack is empty.")
-		os.Exit(0)
+		Raise("StackError", "the stack is empty.")
 	}
 
 	Stack = Stack[:len(Stack)-1]
@@ -879,8 +1386,7 @@ func OpDrop() {
 
 func OpDup() {
 	if len(Stack) < 1 {
-		fmt.Println("Error: 'dup' expected more than one element in stack")
-		os.Exit(0)
+		Raise("StackError", "'dup' expected more than one element in stack")
 	}
 
 	visitedExpr := Stack[len(Stack)-1]
@@ -889,8 +1395,7 @@ func OpDup() {
 
 func OpSwap() {
 	if len(Stack) < 2 {
-		fmt.Println("SwapError: expected more than two elements in stack")
-		os.Exit(0)
+		Raise("StackError", "'swap' expected more than two elements in stack")
 	}
 	visitedExpr := Stack[len(Stack)-1]
 	visitedExprSecond := Stack[len(Stack)-2]
@@ -902,8 +1407,7 @@ func OpSwap() {
 
 func OpOver() {
 	if len(Stack) < 2 {
-		fmt.Println("OverError: expected more than two elements in stack.")
-		os.Exit(0)
+		Raise("StackError", "'over' expected more than two elements in stack.")
 	}
 	visitedExpr := Stack[len(Stack)-1]
 	visitedExprSecond := Stack[len(Stack)-2]
@@ -916,8 +1420,7 @@ func OpOver() {
 
 func OpRot() {
 	if len(Stack) < 3 {
-		fmt.Println("Error: 'rot' expected more than three elements in stack.")
-		os.Exit(0)
+		Raise("StackError", "'rot' expected more than three elements in stack.")
 	}
 	visitedExpr := Stack[len(Stack)-1]
 	visitedExprSecond := Stack[len(Stack)-2]
@@ -932,13 +1435,11 @@ func OpRot() {
 
 func OpInc() {
 	if len(Stack) < 1 {
-		fmt.Println("Error: 'inc' expected more than one element in stack.")
-		os.Exit(0)
+		Raise("StackError", "'inc' expected more than one element in stack.")
 	}
 	visitedExpr := Stack[len(Stack)-1]
 	if visitedExpr.Type != ExprInt {
-		fmt.Println("TypeError: 'inc' expected type int")
-		os.Exit(0)
+		Raise("TypeError", "'inc' expected type int")
 	}
 	visitedExpr.AsInt++
 	OpDrop()
@@ -947,130 +1448,193 @@ func OpInc() {
 
 func OpDec() {
 	if len(Stack) < 1 {
-		fmt.Println("Error: 'dec' expected more than one element in stack.")
-		os.Exit(0)
+		Raise("StackError", "'dec' expected more than one element in stack.")
 	}
 	visitedExpr := Stack[len(Stack)-1]
 	if visitedExpr.Type != ExprInt {
-		fmt.Println("TypeError: 'dec' expected type int")
-		os.Exit(0)
+		Raise("TypeError", "'dec' expected type int")
 	}
 	visitedExpr.AsInt--
 	OpDrop()
 	OpPush(visitedExpr)
 }
 
-func PrintArray(visitedExpr Expr) {
-	fmt.Print("[")
+// Out buffers everything the program prints. It is flushed before
+// reading input, before exiting, and after each line when standard
+// output is a terminal.
+var Out = bufio.NewWriter(os.Stdout)
+
+var OutIsTerminal = isTerminal(os.Stdout)
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func FlushLine() {
+	if OutIsTerminal {
+		Out.Flush()
+	}
+}
+
+// ExprString is the text 'puts' prints for expr.
+func ExprString(expr Expr) string {
+	switch (expr.Type) {
+		case ExprInt: return strconv.Itoa(expr.AsInt)
+		case ExprStr: return expr.AsStr
+		case ExprBool: return strconv.FormatBool(expr.AsBool)
+		case ExprTypeType: return fmt.Sprintf("<%s>", expr.AsType)
+		case ExprArr: return ArrayString(expr)
+	}
+	return ""
+}
+
+// ArrayString shows a list the way 'print' does, with strings quoted.
+func ArrayString(visitedExpr Expr) string {
+	var builder strings.Builder
+	builder.WriteString("[")
 	for i := 0; i < len(visitedExpr.AsArr); i++ {
 		if i != 0 {
-			fmt.Print(", ")
+			builder.WriteString(", ")
 		}
 		switch (visitedExpr.AsArr[i].Type) {
-			case ExprInt: fmt.Print(visitedExpr.AsArr[i].AsInt)
-			case ExprStr: fmt.Print(fmt.Sprintf("'%s'", visitedExpr.AsArr[i].AsStr))
-			case ExprTypeType: fmt.Print(visitedExpr.AsArr[i].AsType)
-			case ExprBool: fmt.Print(visitedExpr.AsArr[i].AsBool)
-			case ExprArr: PrintArray(visitedExpr.AsArr[i])
+			case ExprInt: builder.WriteString(strconv.Itoa(visitedExpr.AsArr[i].AsInt))
+			case ExprStr: builder.WriteString(fmt.Sprintf("'%s'", visitedExpr.AsArr[i].AsStr))
+			case ExprTypeType: builder.WriteString(visitedExpr.AsArr[i].AsType)
+			case ExprBool: builder.WriteString(strconv.FormatBool(visitedExpr.AsArr[i].AsBool))
+			case ExprArr: builder.WriteString(ArrayString(visitedExpr.AsArr[i]))
 		}
 	}
-	fmt.Print("]")
+	builder.WriteString("]")
+	return builder.String()
 }
 
 func OpPuts() {
 	if len(Stack) < 1 {
-		fmt.Println("Error: 'print' expected more than one element in stack.")
-		os.Exit(0)
+		Raise("StackError", "'print' expected more than one element in stack.")
 	}
 
 	visitedExpr := Stack[len(Stack)-1]
-	switch (visitedExpr.Type) {
-		case ExprInt: fmt.Print(visitedExpr.AsInt)
-		case ExprStr: fmt.Print(visitedExpr.AsStr)
-		case ExprBool: fmt.Print(visitedExpr.AsBool)
-		case ExprTypeType: fmt.Print(fmt.Sprintf("<%s>",visitedExpr.AsType))
-		case ExprArr: PrintArray(visitedExpr)
-	}
+	fmt.Fprint(Out, ExprString(visitedExpr))
 	OpDrop()
 }
 
 func OpPrint() {
 	OpPuts()
-	fmt.Println()
+	fmt.Fprintln(Out)
+	FlushLine()
 }
 
 func OpPrintS() {
-	fmt.Print("PrintS ")
-	fmt.Print(fmt.Sprintf("<%d> ", len(Stack)))
+	fmt.Fprint(Out, "PrintS ")
+	fmt.Fprint(Out, fmt.Sprintf("<%d> ", len(Stack)))
 	for i:=len(Stack); i > 0; i-- {
 		visitedExpr := Stack[len(Stack)-i]
-		switch (visitedExpr.Type) {
-			case ExprInt: fmt.Print(visitedExpr.AsInt)
-			case ExprStr: fmt.Print(visitedExpr.AsStr)
-			case ExprBool: fmt.Print(visitedExpr.AsBool)
-			case ExprTypeType: fmt.Print(fmt.Sprintf("<%s>",visitedExpr.AsType))
-			case ExprArr: PrintArray(visitedExpr)
-		}
-		fmt.Print(" ")
+		fmt.Fprint(Out, ExprString(visitedExpr))
+		fmt.Fprint(Out, " ")
 	}
-	fmt.Println("← top")
+	fmt.Fprintln(Out, "← top")
+	FlushLine()
 }
 
 func OpPrintC() {
 	for i:=len(Stack); i > 0; i-- {
 		visitedExpr := Stack[len(Stack)-i]
-		switch (visitedExpr.Type) {
-			case ExprInt: fmt.Print(visitedExpr.AsInt)
-			case ExprStr: fmt.Print(visitedExpr.AsStr)
-			case ExprBool: fmt.Print(visitedExpr.AsBool)
-			case ExprTypeType: fmt.Print(fmt.Sprintf("<%s>",visitedExpr.AsType))
-			case ExprArr: PrintArray(visitedExpr)
-		}
-		fmt.Print(" ")
+		fmt.Fprint(Out, ExprString(visitedExpr))
+		fmt.Fprint(Out, " ")
+	}
+	fmt.Fprintln(Out, " ")
+	FlushLine()
+}
+
+// Stdin is shared by every word that reads standard input, so a line
+// read ahead by one of them is not lost to the others.
+var Stdin = bufio.NewReader(os.Stdin)
+
+// ReadLine reads one line without its line ending. ok is false when
+// standard input was already at end of file.
+func ReadLine() (string, bool) {
+	Out.Flush()
+	line, err := Stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		Raise("IOError", err.Error())
+	}
+	if err == io.EOF && line == "" {
+		return "", false
 	}
-	fmt.Println(" ")
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return line, true
 }
 
+// OpInput pushes the next line of standard input, or "" at end of file.
 func OpInput() {
-	var input string
-	fmt.Scanln(&input)
+	NotInEvaluation("input")
+	input, _ := ReadLine()
 	inpExpr := Expr{}
 	inpExpr.Type = ExprStr
 	inpExpr.AsStr = input
 	OpPush(inpExpr)
 }
 
+func init() {
+	Builtins["eof?"] = func() {
+		NotInEvaluation("eof?")
+		Out.Flush()
+		_, err := Stdin.Peek(1)
+		PushBool(err == io.EOF)
+	}
+	Builtins["read-all"] = func() {
+		NotInEvaluation("read-all")
+		Out.Flush()
+		data, err := io.ReadAll(Stdin)
+		if err != nil {
+			Raise("IOError", err.Error())
+		}
+		PushStr(string(data))
+	}
+	Builtins["lines"] = func() {
+		NotInEvaluation("lines")
+		lines := []Expr{}
+		for {
+			line, ok := ReadLine()
+			if !ok {
+				break
+			}
+			lines = append(lines, Expr{Type: ExprStr, AsStr: line})
+		}
+		PushList(lines)
+	}
+}
 
 func OpTypeOf() {
 	if len(Stack) == 0 {
-		fmt.Println("Error: 'typeof' expected more than one element in stack")
-		os.Exit(0)
+		Raise("StackError", "'typeof' expected more than one element in stack")
 	}
 
 	visitedExpr := Stack[len(Stack)-1]
 	OpDrop()
 	TypeExpr := Expr{}
 	TypeExpr.Type = ExprTypeType
-	var type_value string
-	if visitedExpr.Type == ExprStr {
-		type_value = "string"
-	} else if visitedExpr.Type == ExprInt {
-		type_value = "int"
-	} else if visitedExpr.Type == ExprBool {
-		type_value = "bool"
-	} else if visitedExpr.Type == ExprTypeType {
-		type_value = "type"
-	} else if  visitedExpr.Type == ExprArr {
-		type_value = "list"
-	}
-	TypeExpr.AsType = type_value
+	TypeExpr.AsType = TypeName(visitedExpr)
 	OpPush(TypeExpr)
 }
 
+// TypeName is the name 'typeof' gives the type of expr.
+func TypeName(expr Expr) string {
+	switch expr.Type {
+		case ExprStr: return "string"
+		case ExprInt: return "int"
+		case ExprBool: return "bool"
+		case ExprTypeType: return "type"
+		case ExprArr: return "list"
+	}
+	return ""
+}
+
 func OpCompare(value int) (bool) {
 	if len(Stack) < 2 {
-		fmt.Println("Error: expected more than two elements in stack.")
-		os.Exit(0)
+		Raise("StackError", "expected more than two elements in stack.")
 	}
 
 	visitedExpr := Stack[len(Stack)-1]
@@ -1132,8 +1696,7 @@ func OpCompare(value int) (bool) {
 	}
     
 	if visitedExpr.Type != ExprInt || visitedExprSecond.Type != ExprInt {
-		fmt.Println("TypeError: '<' expected type int")
-		os.Exit(0)
+		Raise("TypeError", "'<' expected type int")
 	}
 
 	if value == TOKEN_LESS_THAN {
@@ -1157,51 +1720,109 @@ func OpCompare(value int) (bool) {
 
 func OpLen() {
 	if len(Stack) < 1 {
-		fmt.Println("Error: 'len' expected more than one elements in stack.")
-		os.Exit(0)
+		Raise("StackError", "'len' expected more than one elements in stack.")
 	}
 
 	visitedExpr := Stack[len(Stack)-1]
 
-	if visitedExpr.Type != ExprArr {
-		fmt.Println("TypeError: 'len' expected type <list>")
-		os.Exit(0)
-	}
-	
 	IntExpr := Expr{}
 	IntExpr.Type = ExprInt
-	IntExpr.AsInt = len(visitedExpr.AsArr)
+	if visitedExpr.Type == ExprStr {
+		IntExpr.AsInt = utf8.RuneCountInString(visitedExpr.AsStr)
+	} else if visitedExpr.Type == ExprArr {
+		IntExpr.AsInt = len(visitedExpr.AsArr)
+	} else {
+		Raise("TypeError", fmt.Sprintf("'len' expected type <list> or <string>, got <%s>", TypeName(visitedExpr)))
+	}
 	OpPush(IntExpr)
 }
 
 func RetBool() (bool) {
 	if len(Stack)-1 < 0 {
-		fmt.Println("Error: the stack is empty, couldn't find bool")
-		os.Exit(0)
+		Raise("StackError", "the stack is empty, couldn't find bool")
 	}
 
 	visitedExpr := Stack[len(Stack)-1]
 	if visitedExpr.Type != ExprBool {
-		fmt.Println("Error: if op should be bool")
-		os.Exit(0)
+		Raise("TypeError", "if op should be bool")
 	}
 	bool_value := visitedExpr.AsBool
 	OpDrop()
 	return bool_value
 }
 
-func OpIf(expr Expr) (bool) {
+func OpIf(expr Expr) (Control) {
 	VisitExpr(expr.AsIf.Op)
 	bool_value := RetBool()
-	var breakValue bool
+	var control Control
 	if bool_value {
-		breakValue = VisitExpr(expr.AsIf.Body)
+		control = VisitExpr(expr.AsIf.Body)
 	} else {
+		for _, elif := range expr.AsIf.Elifs {
+			VisitExpr(elif.Op)
+			if RetBool() {
+				return VisitExpr(elif.Body)
+			}
+		}
 		if expr.AsIf.ElseBody != nil {
-			breakValue = VisitExpr(expr.AsIf.ElseBody)
+			control = VisitExpr(expr.AsIf.ElseBody)
+		}
+	}
+	return control
+}
+
+func OpMatch(expr Expr) (Control) {
+	VisitExpr(expr.AsMatch.Op)
+	if len(Stack) < 1 {
+		Raise("StackError", "'match' expected more than one element in stack.")
+	}
+	visitedExpr := Stack[len(Stack)-1]
+	OpDrop()
+	for _, matchCase := range expr.AsMatch.Cases {
+		if MatchPattern(matchCase.Pattern, visitedExpr) {
+			return VisitExpr(matchCase.Body)
 		}
 	}
-	return breakValue
+	if expr.AsMatch.Default != nil {
+		return VisitExpr(expr.AsMatch.Default)
+	}
+	return Control{}
+}
+
+// MatchPattern reports whether value fits a 'case' pattern. '_' matches
+// anything, a type matches values of that type, a list matches lists
+// of the same length whose elements match, and anything else must be
+// equal to the value.
+func MatchPattern(pattern Expr, value Expr) bool {
+	switch pattern.Type {
+		case ExprId:
+			if pattern.AsId.Name == "_" && pattern.AsId.Index == nil {
+				return true
+			}
+			return MatchPattern(VisitVar(pattern.AsId.Name, pattern), value)
+		case ExprTypeType:
+			if value.Type == ExprTypeType {
+				return value.AsType == pattern.AsType
+			}
+			return TypeName(value) == pattern.AsType
+		case ExprArr:
+			if value.Type != ExprArr || len(value.AsArr) != len(pattern.AsArr) {
+				return false
+			}
+			for i := 0; i < len(pattern.AsArr); i++ {
+				if !MatchPattern(pattern.AsArr[i], value.AsArr[i]) {
+					return false
+				}
+			}
+			return true
+		case ExprInt:
+			return value.Type == ExprInt && value.AsInt == pattern.AsInt
+		case ExprStr:
+			return value.Type == ExprStr && value.AsStr == pattern.AsStr
+		case ExprBool:
+			return value.Type == ExprBool && value.AsBool == pattern.AsBool
+	}
+	return false
 }
 
 func OpCondition(expr Expr) {
@@ -1214,17 +1835,15 @@ func OpCondition(expr Expr) {
 
 func OpBinop(value int) {
 	if len(Stack) < 2 {
-		fmt.Print("Error: ")
+		var op string
 		switch (value) {
-			case TOKEN_PLUS: fmt.Print("'+'")
-			case TOKEN_MINUS: fmt.Print("'-'")
-			case TOKEN_DIV: fmt.Print("'/'")
-			case TOKEN_REM: fmt.Print("'%'")
-			case TOKEN_MUL: fmt.Print("'*'")
-
+			case TOKEN_PLUS: op = "'+'"
+			case TOKEN_MINUS: op = "'-'"
+			case TOKEN_DIV: op = "'/'"
+			case TOKEN_REM: op = "'%'"
+			case TOKEN_MUL: op = "'*'"
 		}
-		fmt.Println(" expected more than two elements in stack")
-		os.Exit(0)
+		Raise("StackError", op + " expected more than two elements in stack")
 	}
 
 	visitedExpr := Stack[len(Stack)-1]
@@ -1241,14 +1860,15 @@ func OpBinop(value int) {
 			ValueExpr.Type = ExprInt
 			ValueExpr.AsInt = visitedExpr.AsInt + visitedExprSecond.AsInt
 		} else {
-			fmt.Println("TypeError: binary operation expected type int")
-			os.Exit(0)
+			Raise("TypeError", "binary operation expected type int")
 		}
 	} else if visitedExpr.Type != ExprInt && visitedExprSecond.Type != ExprInt {
-		fmt.Println("TypeError: binary operation expected type int")
-		os.Exit(0)
+		Raise("TypeError", "binary operation expected type int")
 	} else {
 		ValueExpr.Type = ExprInt
+		if (value == TOKEN_DIV || value == TOKEN_REM) && visitedExpr.AsInt == 0 {
+			Raise("ZeroDivisionError", "integer division by zero")
+		}
 		if value == TOKEN_MINUS {
 			ValueExpr.AsInt = visitedExprSecond.AsInt - visitedExpr.AsInt
 		} else if value == TOKEN_MUL {
@@ -1263,34 +1883,191 @@ func OpBinop(value int) {
 	OpPush(ValueExpr)
 }
 
+// OpImport runs a file at most once per scope: a plain import that
+// was already done in the current module is skipped, and a file
+// imported with 'as' is loaded once and shared by every alias.
 func OpImport(expr Expr) {
-	file, err := os.Open(expr.AsImport)
+	path := ResolveImport(expr.AsImport.Path, expr.AsImport.From)
+	CheckImportCycle(path)
+	if expr.AsImport.Alias == "" {
+		if CurrentModule.Included[path] {
+			return
+		}
+		CurrentModule.Included[path] = true
+		RunImport(expr.AsImport.Path, path, CurrentModule)
+		return
+	}
+	if imported, ok := CurrentModule.Imports[expr.AsImport.Alias]; ok {
+		if imported.Path == path {
+			return
+		}
+		Raise("NameError", fmt.Sprintf("module '%s' is already imported", expr.AsImport.Alias))
+	}
+	module, ok := Modules[path]
+	if !ok {
+		module = NewModule(path)
+		Modules[path] = module
+		RunImport(expr.AsImport.Path, path, module)
+	}
+	CurrentModule.Imports[expr.AsImport.Alias] = module
+}
+
+// RunImport parses the file at path and runs it in module. name is
+// the path as written in the import, used in error messages.
+func RunImport(name string, path string, module *Module) {
+	file, err := OpenImport(path)
 	if err != nil {
-		panic(err)
+		Raise("ImportError", fmt.Sprintf("cannot import '%s': %s", name, err))
+	}
+	exprs := ParseImport(name, path, file)
+	file.Close()
+	ImportChain = append(ImportChain, path)
+	defer func() {
+		ImportChain = ImportChain[:len(ImportChain)-1]
+	}()
+	if Debug != nil {
+		Debug.Enter("import " + name)
+		defer Debug.Leave()
 	}
+	RunInModule(module, exprs)
+}
+
+// ParseImport turns a syntax error in an imported file into an
+// ImportError, so it points at the import rather than at a line of
+// a file the reader cannot see.
+func ParseImport(name string, path string, file io.Reader) (exprs []Expr) {
+	pos := CurrentPos
+	defer func() {
+		if r := recover(); r != nil {
+			if exception, ok := r.(*Exception); ok {
+				CurrentPos = pos
+				Raise("ImportError", fmt.Sprintf("cannot import '%s': %s", name, exception.Error()))
+			}
+			panic(r)
+		}
+	}()
 	lexer := LexerInit(file)
 	parser := ParserInit(lexer)
-	exprs, _ := ParserParse(parser)
-	VisitExpr(exprs)
+	parser.file = path
+	exprs, _ = ParserParse(parser)
+	return exprs
 }
 
-func OpFor(expr Expr) {
+// OpFor runs the loop body while the condition holds.
+func OpFor(expr Expr) (Control) {
 	VisitExpr(expr.AsFor.Op)
 	for RetBool() {
-		BreakValue := VisitExpr(expr.AsFor.Body)
-		if BreakValue == true {break}
+		if done, control := LoopControl(VisitExpr(expr.AsFor.Body), expr.AsFor.Label); done {
+			return control
+		}
 		VisitExpr(expr.AsFor.Op)
 	}
+	return Control{}
+}
+
+// OpForIn binds the loop variable to each element of the list left by
+// the op. An op ending in 'range' is not built into a list; the loop
+// counts from start to stop instead. The variable only lives for the
+// loop: whatever it named before is put back once the loop ends.
+func OpForIn(expr Expr) (Control) {
+	defer RestoreVar(VariableScope, expr.AsFor.Var)()
+	op := expr.AsFor.Op
+	if len(op) > 0 && op[len(op)-1].Type == ExprRange {
+		VisitExpr(op[:len(op)-1])
+		start, stop := RangeBounds()
+		for i := start; i < stop; i++ {
+			VariableScope[expr.AsFor.Var] = Expr{Type: ExprInt, AsInt: i}
+			if done, control := LoopControl(VisitExpr(expr.AsFor.Body), expr.AsFor.Label); done {
+				return control
+			}
+		}
+		return Control{}
+	}
+	VisitExpr(op)
+	if len(Stack) < 1 {
+		Raise("StackError", "'for in' expected more than one element in stack.")
+	}
+	visitedExpr := Stack[len(Stack)-1]
+	if visitedExpr.Type == ExprStr {
+		visitedExpr = Chars(visitedExpr.AsStr)
+	}
+	if visitedExpr.Type != ExprArr {
+		Raise("TypeError", fmt.Sprintf("'for in' expected type <list> or <string>, got <%s>", TypeName(visitedExpr)))
+	}
+	OpDrop()
+	for _, item := range visitedExpr.AsArr {
+		VariableScope[expr.AsFor.Var] = item
+		if done, control := LoopControl(VisitExpr(expr.AsFor.Body), expr.AsFor.Label); done {
+			return control
+		}
+	}
+	return Control{}
+}
+
+// RestoreVar remembers what name is bound to in scope and returns a
+// func that binds it back, or removes it if it was unbound.
+func RestoreVar(scope map[string]Expr, name string) func() {
+	saved, ok := scope[name]
+	return func() {
+		if ok {
+			scope[name] = saved
+		} else {
+			delete(scope, name)
+		}
+	}
+}
+
+// LoopControl decides what a loop does with the signal its body
+// returned. A break or continue carrying another loop's label, and any
+// return, are handed back to the caller.
+func LoopControl(control Control, label string) (bool, Control) {
+	if control.Kind == ControlReturn {
+		return true, control
+	}
+	if control.Label != "" && control.Label != label {
+		return true, control
+	}
+	if control.Kind == ControlBreak {
+		return true, Control{}
+	}
+	return false, Control{}
+}
+
+// RangeBounds pops the stop and start of a range.
+func RangeBounds() (int, int) {
+	if len(Stack) < 2 {
+		Raise("StackError", "'range' expected more than two elements in stack.")
+	}
+	visitedStop := Stack[len(Stack)-1]
+	visitedStart := Stack[len(Stack)-2]
+	if visitedStart.Type != ExprInt || visitedStop.Type != ExprInt {
+		Raise("TypeError", "'range' expected type <int>")
+	}
+	OpDrop()
+	OpDrop()
+	return visitedStart.AsInt, visitedStop.AsInt
+}
+
+// OpRange pushes the list [start, start+1, ..., stop-1].
+func OpRange() {
+	start, stop := RangeBounds()
+	expr := Expr{}
+	expr.Type = ExprArr
+	expr.AsArr = []Expr{}
+	for i := start; i < stop; i++ {
+		expr.AsArr = append(expr.AsArr, Expr{Type: ExprInt, AsInt: i})
+	}
+	OpPush(expr)
 }
 
 func OpAppend(expr Expr) {
 	if len(Stack) < 2 {
-		fmt.Println("Error: 'append' expected more than two element in stack."); os.Exit(0);
+		Raise("StackError", "'append' expected more than two element in stack.")
 	}
 	visitedList := Stack[len(Stack)-2]
 	visitedExpr := Stack[len(Stack)-1]
 	if visitedList.Type != ExprArr {
-		fmt.Println("TypeError: 'append' expected type list"); os.Exit(0);
+		Raise("TypeError", "'append' expected type list")
 	}
 	OpDrop()
 	OpDrop()
@@ -1304,16 +2081,16 @@ func OpAppend(expr Expr) {
 				VarExpr = VisitVar(expr.AsAppend.Index[i].AsId.Name, expr.AsAppend.Index[i])
 				IntValue = VarExpr.AsInt
 			} else if expr.AsAppend.Index[i].Type != ExprInt {
-				fmt.Println("TypeError: 'append' index must be type int"); os.Exit(0);
+				Raise("TypeError", "'append' index must be type int")
 			} else {
 				IntValue = expr.AsAppend.Index[i].AsInt
 			}
-			if len(arr.AsArr) <= IntValue {
-				fmt.Println("Error: 'append' list index out of range"); os.Exit(0);
+			if IntValue < 0 || IntValue >= len(arr.AsArr) {
+				Raise("IndexError", "'append' list index out of range")
 			}
 			arr = &arr.AsArr[IntValue]
 			if arr.Type != ExprArr {
-				fmt.Println("Error: 'append' list index out of range"); os.Exit(0);
+				Raise("IndexError", "'append' list index out of range")
 			}
 		}
 		arr.AsArr = append(arr.AsArr, visitedExpr)
@@ -1332,8 +2109,7 @@ var VariableScope = map[string]Expr{}
 
 func OpVardef(expr Expr) {
 	if len(Stack) < 1 {
-		fmt.Println("Error: variable definition expected more than one element in stack.")
-		os.Exit(0)
+		Raise("StackError", "variable definition expected more than one element in stack.")
 	}
 	exprValue := Stack[len(Stack)-1]
 	VariableScope[expr.AsVardef.Name] = exprValue
@@ -1348,124 +2124,4899 @@ var BlockScope = map[string][]Expr{}
 
 func OpBlockdef(expr Expr) {
 	if _, ok := BlockScope[expr.AsBlockdef.Name]; ok {
-		fmt.Println("Error: block '%s' is already defined", expr.AsBlockdef.Name)
-		os.Exit(0)
+		Raise("NameError", fmt.Sprintf("block '%s' is already defined", expr.AsBlockdef.Name))
 	}
 	BlockScope[expr.AsBlockdef.Name] = expr.AsBlockdef.Body
+	if expr.AsBlockdef.Exported {
+		CurrentModule.Exports[expr.AsBlockdef.Name] = true
+	}
 }
 
 func OpCallBlock(expr Expr) {
+	if expr.AsCall.Module != "" {
+		OpCallQualified(expr)
+		return
+	}
 	if _, ok := BlockScope[expr.AsCall.Value]; ok {
 		BlockBody := BlockScope[expr.AsCall.Value]
+		if Debug != nil {
+			Debug.Enter(expr.AsCall.Value)
+			defer Debug.Leave()
+		}
+		// break, continue and return never leave the block they were called in.
 		VisitExpr(BlockBody)
 	} else {
-		fmt.Println("Error: undefined block '" + expr.AsCall.Value + "'")
-		os.Exit(0)
+		Raise("NameError", "undefined block '" + expr.AsCall.Value + "'")
+	}
+}
+
+
+// 'call m.name' runs an exported block of the module imported as 'm',
+// inside that module's own scope.
+func OpCallQualified(expr Expr) {
+	module, ok := CurrentModule.Imports[expr.AsCall.Module]
+	if !ok {
+		Raise("NameError", fmt.Sprintf("undefined module '%s'", expr.AsCall.Module))
+	}
+	body, ok := module.Blocks[expr.AsCall.Value]
+	if !ok {
+		Raise("NameError", fmt.Sprintf("undefined block '%s.%s'", expr.AsCall.Module, expr.AsCall.Value))
+	}
+	if !module.Exports[expr.AsCall.Value] {
+		Raise("NameError", fmt.Sprintf("block '%s' is not exported by '%s'", expr.AsCall.Value, expr.AsCall.Module))
 	}
+	if Debug != nil {
+		Debug.Enter(expr.AsCall.Module + "." + expr.AsCall.Value)
+		defer Debug.Leave()
+	}
+	RunInModule(module, body)
 }
 
 
 // -----------------------------
-// -------- Visit Exprs --------
+// ---------- Module -----------
 // -----------------------------
 
-func VisitExpr(exprs []Expr) (bool) {
-	BreakValue := false
-	for _, expr := range exprs {
-		switch expr.Type {
-			case ExprPush:
-				OpPush(expr.AsPush.Arg)
-			case ExprPrint:
-				OpPrint()
-			case ExprInput:
-				OpInput()
-			case ExprPuts:
-				OpPuts()
-			case ExprPrintS:
-				OpPrintS()
-			case ExprPrintC:
-				OpPrintC()
-			case ExprAppend:
-				OpAppend(expr)
-			case ExprTypeOf:
-				OpTypeOf()
-			case ExprSwap:
-				OpSwap()
-			case ExprOver:
-				OpOver()
-			case ExprRot:
-				OpRot()
-			case ExprInc:
-				OpInc()
-			case ExprDec:
-				OpDec()
-			case ExprImport:
-				OpImport(expr)
-			case ExprDup:
-				OpDup()
-			case ExprDrop:
-				OpDrop()
-			case ExprLen:
-				OpLen()
-			case ExprExit:
-				os.Exit(0)
-			case ExprBinop:
-				OpBinop(expr.AsBiniop)
-			case ExprCompare:
-				OpCondition(expr)
-			case ExprBlockdef:
-				OpBlockdef(expr)
-			case ExprCall:
-				OpCallBlock(expr)
-			case ExprIf:
-				BreakValue = OpIf(expr)
-			case ExprFor:
-				OpFor(expr)
-			case ExprVardef:
-				OpVardef(expr)
-			case ExprBreak:
-				BreakValue = true
+// Module is the scope a file runs in. The main file and its plain
+// imports share one; 'import "file" as m' gives the file a new one.
+type Module struct {
+	Path string
+	Blocks map[string][]Expr
+	Variables map[string]Expr
+	Exports map[string]bool
+	Imports map[string]*Module
+	Included map[string]bool
+}
+
+func NewModule(path string) *Module {
+	return &Module{
+		Path: path,
+		Blocks: map[string][]Expr{},
+		Variables: map[string]Expr{},
+		Exports: map[string]bool{},
+		Imports: map[string]*Module{},
+		Included: map[string]bool{path: true},
+	}
+}
+
+var CurrentModule = &Module{
+	Blocks: BlockScope,
+	Variables: VariableScope,
+	Exports: map[string]bool{},
+	Imports: map[string]*Module{},
+	Included: map[string]bool{},
+}
+
+// Modules holds every file imported with 'as', by absolute path.
+var Modules = map[string]*Module{}
+
+// ImportChain holds the files being run, the main script first, so
+// an import cycle can be reported as the chain of files that closes it.
+var ImportChain []string
+
+// SearchPath lists the directories tried, in order, for an import
+// that is not found next to the importing file.
+var SearchPath []string
+
+// InitSearchPath builds SearchPath from TSHARP_PATH, the lib/
+// directory of the project the script belongs to, and the directories
+// of the project's dependencies. A broken tsh.mod only gets a
+// warning here: the script may not belong to that project at all.
+func InitSearchPath(script string) {
+	manifest, err := ReadProject(filepath.Dir(script))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: " + err.Error() + ", ignoring it")
+	}
+	Project = manifest
+	SearchPath = ProjectSearchPath(script, Project)
+}
+
+// ProjectSearchPath is the SearchPath of a script in the project
+// described by manifest, which may be nil.
+func ProjectSearchPath(script string, manifest *Manifest) []string {
+	dirs := []string{}
+	for _, dir := range filepath.SplitList(os.Getenv("TSHARP_PATH")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
 		}
-		if BreakValue {
-			break
+	}
+	dirs = append(dirs, filepath.Join(ProjectRoot(script), "lib"))
+	if manifest != nil {
+		dirs = append(dirs, manifest.DependencyDirs()...)
+	}
+	return append(dirs, filepath.Join(ProjectRoot(script), ModulesDir))
+}
+
+// ProjectRoot is the nearest directory at or above the script's that
+// holds a tsh.mod, or the script's own directory when none does.
+func ProjectRoot(script string) string {
+	root, _ := FindProject(filepath.Dir(script))
+	return root
+}
+
+// ResolveImport finds the file an import names and returns its
+// absolute path. A relative path is looked up next to the importing
+// file first, then in each SearchPath directory, then in the working
+// directory.
+func ResolveImport(path string, from string) string {
+	if name, ok := StdModule(path); ok {
+		return name
+	}
+	dirs := []string{""}
+	if !filepath.IsAbs(path) {
+		dir := "."
+		if from != "" {
+			dir = filepath.Dir(from)
+		}
+		dirs = append([]string{dir}, SearchPath...)
+		if dir != "." {
+			// the working directory comes last, as it did before
+			// imports were looked up next to the importing file
+			dirs = append(dirs, ".")
+		}
+	}
+	names := []string{path}
+	if filepath.Ext(path) == "" {
+		names = append(names, path + ".t#")
+	}
+	for _, dir := range dirs {
+		for _, name := range names {
+			candidate := filepath.Join(dir, name)
+			if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+				if abs, err := filepath.Abs(candidate); err == nil {
+					return abs
+				}
+				return candidate
+			}
 		}
 	}
-	return BreakValue
+	if filepath.IsAbs(path) {
+		Raise("ImportError", fmt.Sprintf("cannot import '%s': file does not exist", path))
+	}
+	tried := make([]string, len(dirs))
+	for i, dir := range dirs {
+		tried[i] = "'" + DisplayPath(dir) + "'"
+	}
+	Raise("ImportError", fmt.Sprintf("cannot import '%s': not found in %s", path, strings.Join(tried, ", ")))
+	return ""
+}
+
+// CheckImportCycle raises ImportError when path is already being run
+// further up the import chain.
+func CheckImportCycle(path string) {
+	for i, loading := range ImportChain {
+		if loading == path {
+			chain := []string{}
+			for _, file := range ImportChain[i:] {
+				chain = append(chain, DisplayPath(file))
+			}
+			chain = append(chain, DisplayPath(path))
+			Raise("ImportError", fmt.Sprintf("import cycle: %s", strings.Join(chain, " -> ")))
+		}
+	}
+}
+
+// DisplayPath shortens path to be relative to the working directory
+// when it lies below it.
+func DisplayPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return abs
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return abs
+	}
+	return rel
+}
+
+// RunInModule visits exprs with module's blocks and variables in
+// scope, and puts the caller's scope back afterwards, even when an
+// exception unwinds through it.
+func RunInModule(module *Module, exprs []Expr) Control {
+	saved := CurrentModule
+	CurrentModule, BlockScope, VariableScope = module, module.Blocks, module.Variables
+	defer func() {
+		CurrentModule, BlockScope, VariableScope = saved, saved.Blocks, saved.Variables
+	}()
+	return VisitExpr(exprs)
 }
 
 
 // -----------------------------
-// ----------- Main ------------
+// ---------- Std --------------
 // -----------------------------
 
-func Usage() {
-	fmt.Println("Usage:")
-	fmt.Println("  tsh <filename>.t#")
-	os.Exit(0)
+// StdLib holds the modules of the standard library written in T#.
+//go:embed std/*.t#
+var StdLib embed.FS
+
+// StdModule reports whether an import names a standard module, and
+// its canonical name, "std/list" for both "std/list" and "std/list.t#".
+// An unknown "std/" name is an ImportError rather than a file lookup.
+func StdModule(path string) (string, bool) {
+	if !strings.HasPrefix(path, "std/") {
+		return "", false
+	}
+	name := strings.TrimSuffix(path, ".t#")
+	if _, err := fs.Stat(StdLib, name + ".t#"); err == nil {
+		return name, true
+	}
+	Raise("ImportError", fmt.Sprintf("cannot import '%s': no such standard module", path))
+	return "", false
 }
 
+// OpenImport opens a resolved import, reading standard modules from
+// the interpreter itself.
+func OpenImport(path string) (io.ReadCloser, error) {
+	if strings.HasPrefix(path, "std/") {
+		return StdLib.Open(path + ".t#")
+	}
+	return os.Open(path)
+}
 
-func main() {
-	if len(os.Args) != 2 || os.Args[1] == "help" {
-		Usage()
+// StdModules lists the names of every standard module, sorted.
+func StdModules() []string {
+	names := []string{}
+	entries, _ := StdLib.ReadDir("std")
+	for _, entry := range entries {
+		names = append(names, "std/" + strings.TrimSuffix(entry.Name(), ".t#"))
 	}
+	sort.Strings(names)
+	return names
+}
 
-	file, err := os.Open(os.Args[1])
-	if err != nil {
-		fmt.Println("Error: file '" + os.Args[1] + "' does not exist")
+// BlockDoc is the doc comment of a block, split into its stack effect
+// and the description that follows it.
+type BlockDoc struct {
+	Name string
+	Effect string
+	Doc string
+	Line int
+	Exported bool
+}
 
-		whilte := color.New(color.FgWhite)
+var blockLine = regexp.MustCompile(`^(export\s+)?block\s+([^\s]+)`)
 
-		fmt.Print("Run ")
-		boldWhite := whilte.Add(color.BgCyan)
-		boldWhite.Print(" tsh help ")
-		fmt.Println(" for usage")
+// ParseDocs reads the doc comments of a T# source: the comment that
+// opens the file when a blank line follows it, and the comment lines
+// directly above each block definition.
+func ParseDocs(src string) (string, []BlockDoc) {
+	header := ""
+	docs := []BlockDoc{}
+	comment := []string{}
+	seenCode := false
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			comment = append(comment, strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			continue
+		}
+		if line == "" {
+			if !seenCode && header == "" {
+				header = strings.Join(comment, " ")
+			}
+			seenCode = seenCode || len(comment) > 0
+			comment = nil
+			continue
+		}
+		seenCode = true
+		if match := blockLine.FindStringSubmatch(line); match != nil {
+			doc := BlockDoc{Name: match[2], Doc: strings.Join(comment, " "), Line: i + 1, Exported: match[1] != ""}
+			if strings.HasPrefix(doc.Doc, "(") {
+				if end := strings.Index(doc.Doc, ")"); end >= 0 {
+					doc.Effect = doc.Doc[:end+1]
+					doc.Doc = strings.TrimSpace(doc.Doc[end+1:])
+				}
+			}
+			docs = append(docs, doc)
+		}
+		comment = nil
+	}
+	return header, docs
+}
 
-		os.Exit(0)
+// WriteDocs prints the documentation of one module as markdown. Only
+// exported blocks are shown, unless the module exports none.
+func WriteDocs(w io.Writer, name string, header string, docs []BlockDoc) {
+	fmt.Fprintf(w, "## %s\n", name)
+	if header != "" {
+		fmt.Fprintf(w, "\n%s\n", header)
+	}
+	exported := false
+	for _, doc := range docs {
+		exported = exported || doc.Exported
+	}
+	for _, doc := range docs {
+		if exported && !doc.Exported {
+			continue
+		}
+		fmt.Fprintf(w, "\n### %s\n", doc.Name)
+		if doc.Effect != "" {
+			fmt.Fprintf(w, "`%s` ", doc.Effect)
+		}
+		fmt.Fprintln(w, doc.Doc)
 	}
+}
 
-	lexer := LexerInit(file)
-	parser := ParserInit(lexer)
-	exprs, _ := ParserParse(parser)
-	VisitExpr(exprs)
+// DocCommand implements 'tsh doc': markdown for the given standard
+// modules or files, or for the whole standard library.
+func DocCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(Out, "# Standard library")
+		fmt.Fprintln(Out)
+		fmt.Fprintln(Out, "Generated by 'tsh doc' from the sources in std/.")
+		args = StdModules()
+	}
+	for i, arg := range args {
+		if i > 0 || len(args) > 1 {
+			fmt.Fprintln(Out)
+		}
+		var src []byte
+		var err error
+		if strings.HasPrefix(arg, "std/") {
+			src, err = StdLib.ReadFile(strings.TrimSuffix(arg, ".t#") + ".t#")
+		} else {
+			src, err = os.ReadFile(arg)
+		}
+		if err != nil {
+			Out.Flush()
+			fmt.Fprintln(os.Stderr, "Error: cannot read '" + arg + "'")
+			return ExitNoInput
+		}
+		header, docs := ParseDocs(string(src))
+		WriteDocs(Out, strings.TrimSuffix(arg, ".t#"), header, docs)
+	}
+	return ExitOK
+}
+
+
+// -----------------------------
+// ---------- Builtins ---------
+// -----------------------------
+
+// Builtins maps a word to the function that runs it. Words that need
+// no syntax of their own are registered here rather than getting an
+// ExprType and a parser branch each.
+var Builtins = map[string]func(){}
+
+func init() {
+	Builtins["and"] = func() { b, a := PopBool("and"), PopBool("and"); PushBool(a && b) }
+	Builtins["or"] = func() { b, a := PopBool("or"), PopBool("or"); PushBool(a || b) }
+	Builtins["xor"] = func() { b, a := PopBool("xor"), PopBool("xor"); PushBool(a != b) }
+	Builtins["not"] = func() { PushBool(!PopBool("not")) }
+	Builtins["band"] = func() { b, a := PopInt("band"), PopInt("band"); PushInt(a & b) }
+	Builtins["bor"] = func() { b, a := PopInt("bor"), PopInt("bor"); PushInt(a | b) }
+	Builtins["bxor"] = func() { b, a := PopInt("bxor"), PopInt("bxor"); PushInt(a ^ b) }
+	Builtins["bnot"] = func() { PushInt(^PopInt("bnot")) }
+	Builtins["shl"] = func() { n, a := PopShift("shl"), PopInt("shl"); PushInt(a << n) }
+	Builtins["shr"] = func() { n, a := PopShift("shr"), PopInt("shr"); PushInt(a >> n) }
+}
+
+// String words. Positions and lengths count runes, not bytes.
+func init() {
+	Builtins["substr"] = func() {
+		end, start := PopInt("substr"), PopInt("substr")
+		runes := []rune(PopStr("substr"))
+		if start < 0 || end < start || end > len(runes) {
+			Raise("IndexError", fmt.Sprintf("'substr' range %d..%d out of range for length %d", start, end, len(runes)))
+		}
+		PushStr(string(runes[start:end]))
+	}
+	Builtins["split"] = func() {
+		sep, str := PopStr("split"), PopStr("split")
+		if sep == "" {
+			OpPush(Chars(str))
+			return
+		}
+		parts := []Expr{}
+		for _, part := range strings.Split(str, sep) {
+			parts = append(parts, Expr{Type: ExprStr, AsStr: part})
+		}
+		PushList(parts)
+	}
+	Builtins["join"] = func() {
+		sep, list := PopStr("join"), PopList("join")
+		parts := []string{}
+		for _, item := range list {
+			if item.Type != ExprStr {
+				Raise("TypeError", fmt.Sprintf("'join' expected a list of <string>, got <%s>", TypeName(item)))
+			}
+			parts = append(parts, item.AsStr)
+		}
+		PushStr(strings.Join(parts, sep))
+	}
+	Builtins["trim"] = func() { PushStr(strings.TrimSpace(PopStr("trim"))) }
+	Builtins["upper"] = func() { PushStr(strings.ToUpper(PopStr("upper"))) }
+	Builtins["lower"] = func() { PushStr(strings.ToLower(PopStr("lower"))) }
+	Builtins["contains"] = func() { sub, str := PopStr("contains"), PopStr("contains"); PushBool(strings.Contains(str, sub)) }
+	Builtins["starts-with"] = func() { prefix, str := PopStr("starts-with"), PopStr("starts-with"); PushBool(strings.HasPrefix(str, prefix)) }
+	Builtins["ends-with"] = func() { suffix, str := PopStr("ends-with"), PopStr("ends-with"); PushBool(strings.HasSuffix(str, suffix)) }
+	Builtins["replace"] = func() {
+		with, old, str := PopStr("replace"), PopStr("replace"), PopStr("replace")
+		PushStr(strings.ReplaceAll(str, old, with))
+	}
+	Builtins["index-of"] = func() {
+		sub, str := PopStr("index-of"), PopStr("index-of")
+		i := strings.Index(str, sub)
+		if i >= 0 {
+			i = utf8.RuneCountInString(str[:i])
+		}
+		PushInt(i)
+	}
+	Builtins["repeat"] = func() {
+		n, str := PopInt("repeat"), PopStr("repeat")
+		if n < 0 {
+			Raise("ValueError", "'repeat' count must not be negative")
+		}
+		PushStr(strings.Repeat(str, n))
+	}
+	Builtins["chars"] = func() { OpPush(Chars(PopStr("chars"))) }
+	Builtins["ord"] = func() {
+		runes := []rune(PopStr("ord"))
+		if len(runes) != 1 {
+			Raise("ValueError", fmt.Sprintf("'ord' expected a string of one character, got length %d", len(runes)))
+		}
+		PushInt(int(runes[0]))
+	}
+	Builtins["chr"] = func() {
+		code := PopInt("chr")
+		if code < 0 || code > unicode.MaxRune || !utf8.ValidRune(rune(code)) {
+			Raise("ValueError", fmt.Sprintf("'chr' %d is not a valid code point", code))
+		}
+		PushStr(string(rune(code)))
+	}
+}
+
+// Chars splits str into a list of one-rune strings.
+func Chars(str string) Expr {
+	expr := Expr{}
+	expr.Type = ExprArr
+	expr.AsArr = []Expr{}
+	for _, r := range str {
+		expr.AsArr = append(expr.AsArr, Expr{Type: ExprStr, AsStr: string(r)})
+	}
+	return expr
+}
+
+// Conversion words. 'cast' takes the target as a type value, so
+// '"42" int cast' is the same as '"42" to-int'.
+func init() {
+	Builtins["to-int"] = func() { OpPush(ToInt(PopExpr("to-int"))) }
+	Builtins["to-str"] = func() { PushStr(ExprString(PopExpr("to-str"))) }
+	Builtins["to-bool"] = func() { OpPush(ToBool(PopExpr("to-bool"))) }
+	Builtins["to-list"] = func() { OpPush(ToList(PopExpr("to-list"))) }
+	Builtins["cast"] = func() {
+		target := PopType("cast", ExprTypeType, "type")
+		visitedExpr := PopExpr("cast")
+		switch target.AsType {
+			case "int": OpPush(ToInt(visitedExpr))
+			case "string": PushStr(ExprString(visitedExpr))
+			case "bool": OpPush(ToBool(visitedExpr))
+			case "list": OpPush(ToList(visitedExpr))
+			case "type": OpPush(Expr{Type: ExprTypeType, AsType: TypeName(visitedExpr)})
+		}
+	}
+	Builtins["try-int"] = func() {
+		visitedExpr := PopExpr("try-int")
+		if visitedExpr.Type == ExprInt || (visitedExpr.Type == ExprStr && isInt(strings.TrimSpace(visitedExpr.AsStr))) {
+			OpPush(ToInt(visitedExpr))
+			PushBool(true)
+			return
+		}
+		OpPush(visitedExpr)
+		PushBool(false)
+	}
+}
+
+func ToInt(expr Expr) Expr {
+	switch expr.Type {
+		case ExprInt:
+			return expr
+		case ExprStr:
+			num := strings.TrimSpace(expr.AsStr)
+			if !isInt(num) {
+				Raise("ValueError", fmt.Sprintf("cannot convert '%s' to <int>", expr.AsStr))
+			}
+			return Expr{Type: ExprInt, AsInt: StrToInt(num)}
+		case ExprBool:
+			if expr.AsBool {
+				return Expr{Type: ExprInt, AsInt: 1}
+			}
+			return Expr{Type: ExprInt, AsInt: 0}
+	}
+	Raise("TypeError", fmt.Sprintf("cannot convert <%s> to <int>", TypeName(expr)))
+	return expr
+}
+
+// ToBool accepts "true" and "false", treats non-zero ints and
+// non-empty lists as true.
+func ToBool(expr Expr) Expr {
+	switch expr.Type {
+		case ExprBool:
+			return expr
+		case ExprInt:
+			return Expr{Type: ExprBool, AsBool: expr.AsInt != 0}
+		case ExprStr:
+			switch strings.TrimSpace(expr.AsStr) {
+				case "true":
+					return Expr{Type: ExprBool, AsBool: true}
+				case "false":
+					return Expr{Type: ExprBool, AsBool: false}
+			}
+			Raise("ValueError", fmt.Sprintf("cannot convert '%s' to <bool>", expr.AsStr))
+		case ExprArr:
+			return Expr{Type: ExprBool, AsBool: len(expr.AsArr) > 0}
+	}
+	Raise("TypeError", fmt.Sprintf("cannot convert <%s> to <bool>", TypeName(expr)))
+	return expr
+}
+
+// ToList splits a string into its characters and wraps anything else
+// that is not a list in a list of one.
+func ToList(expr Expr) Expr {
+	switch expr.Type {
+		case ExprArr:
+			return expr
+		case ExprStr:
+			return Chars(expr.AsStr)
+	}
+	return Expr{Type: ExprArr, AsArr: []Expr{expr}}
+}
+
+// -- format --
+//
+// A placeholder is '{name:spec}'. An empty name takes the next value
+// given to 'format'; any other name is read like a variable, so
+// '{x}' and '{row[2]}' both work. '{{' and '}}' are literal braces.
+//
+// spec is [[fill]align][0][width][.precision]: align is '<', '>' or '^',
+// '0' pads ints with zeros after the sign, width is the minimum number
+// of characters and precision the maximum.
+
+type Placeholder struct {
+	Text string
+	Name string
+	Spec string
+	IsText bool
+}
+
+func ParseTemplate(template string) []Placeholder {
+	parts := []Placeholder{}
+	runes := []rune(template)
+	var text []rune
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if (r == '{' || r == '}') && i+1 < len(runes) && runes[i+1] == r {
+			text = append(text, r)
+			i++
+			continue
+		}
+		if r == '}' {
+			Raise("FormatError", fmt.Sprintf("unmatched '}' in '%s'", template))
+		}
+		if r != '{' {
+			text = append(text, r)
+			continue
+		}
+		end := i + 1
+		for end < len(runes) && runes[end] != '}' {
+			end++
+		}
+		if end == len(runes) {
+			Raise("FormatError", fmt.Sprintf("unclosed '{' in '%s'", template))
+		}
+		if len(text) > 0 {
+			parts = append(parts, Placeholder{Text: string(text), IsText: true})
+			text = nil
+		}
+		field := string(runes[i+1:end])
+		placeholder := Placeholder{Name: field}
+		if colon := strings.Index(field, ":"); colon >= 0 {
+			placeholder.Name, placeholder.Spec = field[:colon], field[colon+1:]
+		}
+		placeholder.Name = strings.TrimSpace(placeholder.Name)
+		parts = append(parts, placeholder)
+		i = end
+	}
+	if len(text) > 0 {
+		parts = append(parts, Placeholder{Text: string(text), IsText: true})
+	}
+	return parts
+}
+
+// Format fills the placeholders of template, taking unnamed ones from
+// args in order.
+func Format(template string, args []Expr) string {
+	var builder strings.Builder
+	next := 0
+	for _, part := range ParseTemplate(template) {
+		if part.IsText {
+			builder.WriteString(part.Text)
+			continue
+		}
+		var value Expr
+		if part.Name == "" {
+			if next >= len(args) {
+				Raise("FormatError", fmt.Sprintf("not enough values for '%s'", template))
+			}
+			value = args[next]
+			next++
+		} else {
+			ref := PlaceholderVar(part.Name)
+			value = VisitVar(ref.AsId.Name, ref)
+		}
+		builder.WriteString(FormatValue(value, part.Spec))
+	}
+	return builder.String()
+}
+
+// PlaceholderVar parses the name of a placeholder as a variable
+// reference such as 'row[i][0]'.
+func PlaceholderVar(name string) (expr Expr) {
+	pos := CurrentPos
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*Exception); ok {
+				CurrentPos = pos
+				Raise("FormatError", fmt.Sprintf("'{%s}' is not a variable", name))
+			}
+			panic(r)
+		}
+	}()
+	parser := ParserInit(LexerInit(strings.NewReader(name)))
+	expr = ParserParseExpr(parser)
+	if expr.Type != ExprId || parser.current_token_type != TOKEN_EOF {
+		parser.SyntaxError("not a variable")
+	}
+	return expr
+}
+
+// MaxFormatWidth is the widest a placeholder can pad its value.
+const MaxFormatWidth = 1024
+
+func FormatValue(value Expr, spec string) string {
+	str := ExprString(value)
+	if spec == "" {
+		return str
+	}
+	specRunes := []rune(spec)
+	fill, align := ' ', rune(0)
+	if len(specRunes) >= 2 && strings.ContainsRune("<>^", specRunes[1]) {
+		fill, align = specRunes[0], specRunes[1]
+		specRunes = specRunes[2:]
+	} else if len(specRunes) >= 1 && strings.ContainsRune("<>^", specRunes[0]) {
+		align = specRunes[0]
+		specRunes = specRunes[1:]
+	}
+	zero := false
+	if len(specRunes) > 0 && specRunes[0] == '0' {
+		zero = true
+		specRunes = specRunes[1:]
+	}
+	rest := string(specRunes)
+	widthText, precisionText := rest, ""
+	if dot := strings.Index(rest, "."); dot >= 0 {
+		widthText, precisionText = rest[:dot], rest[dot+1:]
+		if precisionText == "" {
+			Raise("FormatError", fmt.Sprintf("missing precision in '{:%s}'", spec))
+		}
+	}
+	width, precision := 0, -1
+	if widthText != "" {
+		if !isInt(widthText) {
+			Raise("FormatError", fmt.Sprintf("bad format spec '{:%s}'", spec))
+		}
+		width = StrToInt(widthText)
+		if width > MaxFormatWidth {
+			Raise("ValueError", fmt.Sprintf("width in '{:%s}' is larger than %d", spec, MaxFormatWidth))
+		}
+	}
+	if precisionText != "" {
+		if !isInt(precisionText) {
+			Raise("FormatError", fmt.Sprintf("bad format spec '{:%s}'", spec))
+		}
+		precision = StrToInt(precisionText)
+		if value.Type == ExprInt {
+			// cutting digits off a number would print a different number
+			Raise("ValueError", fmt.Sprintf("precision in '{:%s}' is not allowed for <int>", spec))
+		}
+	}
+	runes := []rune(str)
+	if precision >= 0 && len(runes) > precision {
+		runes = runes[:precision]
+	}
+	pad := width - len(runes)
+	if pad <= 0 {
+		return string(runes)
+	}
+	if zero && align == 0 && value.Type == ExprInt {
+		if len(runes) > 0 && runes[0] == '-' {
+			return "-" + strings.Repeat("0", pad) + string(runes[1:])
+		}
+		return strings.Repeat("0", pad) + string(runes)
+	}
+	if align == 0 {
+		// numbers line up on the right, everything else on the left
+		align = '<'
+		if value.Type == ExprInt {
+			align = '>'
+		}
+	}
+	padding := string(fill)
+	switch align {
+		case '>':
+			return strings.Repeat(padding, pad) + string(runes)
+		case '^':
+			return strings.Repeat(padding, pad/2) + string(runes) + strings.Repeat(padding, pad-pad/2)
+	}
+	return string(runes) + strings.Repeat(padding, pad)
+}
+
+// FormatArgs pops the template and one value for each unnamed
+// placeholder. The deepest value fills the first placeholder.
+func FormatArgs(word string) string {
+	template := PopStr(word)
+	count := 0
+	for _, part := range ParseTemplate(template) {
+		if !part.IsText && part.Name == "" {
+			count++
+		}
+	}
+	if len(Stack) < count {
+		Raise("StackError", fmt.Sprintf("'%s' expected %d values for '%s' but the stack has %d", word, count, template, len(Stack)))
+	}
+	args := make([]Expr, count)
+	copy(args, Stack[len(Stack)-count:])
+	Stack = Stack[:len(Stack)-count]
+	return Format(template, args)
+}
+
+func init() {
+	Builtins["format"] = func() { PushStr(FormatArgs("format")) }
+	Builtins["printf"] = func() { fmt.Fprintln(Out, FormatArgs("printf")); FlushLine() }
+}
+
+// File system words. Failures raise an IOError that 'try' can catch.
+func init() {
+	Builtins["read-file"] = func() {
+		path := PopStr("read-file")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			RaiseIO("read", path, err)
+		}
+		PushStr(string(data))
+	}
+	Builtins["write-file"] = func() {
+		path, content := PopStr("write-file"), PopStr("write-file")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			RaiseIO("write", path, err)
+		}
+	}
+	Builtins["append-file"] = func() {
+		path, content := PopStr("append-file"), PopStr("append-file")
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			RaiseIO("append to", path, err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(content); err != nil {
+			RaiseIO("append to", path, err)
+		}
+	}
+	Builtins["exists?"] = func() {
+		_, err := os.Stat(PopStr("exists?"))
+		PushBool(err == nil)
+	}
+	Builtins["remove"] = func() {
+		path := PopStr("remove")
+		if err := os.Remove(path); err != nil {
+			RaiseIO("remove", path, err)
+		}
+	}
+	Builtins["mkdir"] = func() {
+		path := PopStr("mkdir")
+		if err := os.MkdirAll(path, 0755); err != nil {
+			RaiseIO("create directory", path, err)
+		}
+	}
+	Builtins["list-dir"] = func() {
+		path := PopStr("list-dir")
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			RaiseIO("list", path, err)
+		}
+		names := []Expr{}
+		for _, entry := range entries {
+			names = append(names, Expr{Type: ExprStr, AsStr: entry.Name()})
+		}
+		PushList(names)
+	}
+	Builtins["file-lines"] = func() {
+		path := PopStr("file-lines")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			RaiseIO("read", path, err)
+		}
+		lines := []Expr{}
+		text := strings.TrimSuffix(string(data), "\n")
+		if text != "" {
+			for _, line := range strings.Split(text, "\n") {
+				lines = append(lines, Expr{Type: ExprStr, AsStr: strings.TrimSuffix(line, "\r")})
+			}
+		}
+		PushList(lines)
+	}
+	Builtins["path-join"] = func() { elem, dir := PopStr("path-join"), PopStr("path-join"); PushStr(filepath.Join(dir, elem)) }
+	Builtins["basename"] = func() { PushStr(filepath.Base(PopStr("basename"))) }
+	Builtins["dirname"] = func() { PushStr(filepath.Dir(PopStr("dirname"))) }
+}
+
+// RaiseIO raises an IOError for a failed file operation, keeping the
+// reason but not Go's own wording of the path.
+func RaiseIO(action string, path string, err error) {
+	var pathError *os.PathError
+	if errors.As(err, &pathError) {
+		err = pathError.Err
+	}
+	Raise("IOError", fmt.Sprintf("cannot %s '%s': %s", action, path, err))
+}
+
+// Process words. 'exec' runs a program directly, 'shell' hands a
+// command line to the system shell. Both push stdout, stderr and the
+// exit status; the '-stream' variants share the terminal instead and
+// push only the status.
+func init() {
+	Builtins["exec"] = func() { RunCommand(CommandArgs("exec", false), false) }
+	Builtins["shell"] = func() { RunCommand(CommandArgs("shell", true), false) }
+	Builtins["exec-stream"] = func() { RunCommand(CommandArgs("exec-stream", false), true) }
+	Builtins["shell-stream"] = func() { RunCommand(CommandArgs("shell-stream", true), true) }
+}
+
+// Sandbox is set by the --sandbox flag. It turns off every word that
+// starts another process.
+var Sandbox = false
+
+// CommandArgs pops a command, either a list of strings or a string.
+// For 'exec' a string is split on white space; for 'shell' it is run
+// by the system shell.
+func CommandArgs(word string, shell bool) []string {
+	if Sandbox {
+		Raise("PermissionError", fmt.Sprintf("'%s' is disabled in sandbox mode", word))
+	}
+	visitedExpr := PopExpr(word)
+	var command []string
+	if visitedExpr.Type == ExprStr {
+		if shell {
+			if runtime.GOOS == "windows" {
+				return []string{"cmd", "/C", visitedExpr.AsStr}
+			}
+			return []string{"sh", "-c", visitedExpr.AsStr}
+		}
+		command = strings.Fields(visitedExpr.AsStr)
+	} else if visitedExpr.Type == ExprArr && !shell {
+		for _, item := range visitedExpr.AsArr {
+			if item.Type != ExprStr {
+				Raise("TypeError", fmt.Sprintf("'%s' expected a list of <string>, got <%s>", word, TypeName(item)))
+			}
+			command = append(command, item.AsStr)
+		}
+	} else if shell {
+		Raise("TypeError", fmt.Sprintf("'%s' expected type <string>, got <%s>", word, TypeName(visitedExpr)))
+	} else {
+		Raise("TypeError", fmt.Sprintf("'%s' expected type <list> or <string>, got <%s>", word, TypeName(visitedExpr)))
+	}
+	if len(command) == 0 {
+		Raise("ValueError", fmt.Sprintf("'%s' command is empty", word))
+	}
+	return command
+}
+
+func RunCommand(command []string, stream bool) {
+	cmd := exec.Command(command[0], command[1:]...)
+	var stdout, stderr bytes.Buffer
+	if stream {
+		Out.Flush()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if n := Stdin.Buffered(); n > 0 {
+			// Hand over only what 'input' already read ahead. Reading
+			// on through Stdin would block on the terminal after the
+			// program is done and keep Run from returning.
+			ahead, _ := Stdin.Peek(n)
+			cmd.Stdin = bytes.NewReader(append([]byte{}, ahead...))
+			Stdin.Discard(n)
+		}
+	} else {
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	}
+	err := cmd.Run()
+	status := 0
+	if err != nil {
+		var exitError *exec.ExitError
+		if !errors.As(err, &exitError) {
+			if reason := errors.Unwrap(err); reason != nil {
+				err = reason
+			}
+			Raise("ExecError", fmt.Sprintf("cannot run '%s': %s", command[0], err))
+		}
+		status = exitError.ExitCode()
+	}
+	if !stream {
+		PushStr(stdout.String())
+		PushStr(stderr.String())
+	}
+	PushInt(status)
+}
+
+// -- json --
+//
+// JSON arrays become lists, strings, integers and booleans map to the
+// T# type of the same name. T# has no map, null or float type, so
+// objects, null and non-integer numbers are reported as errors.
+
+func init() {
+	Builtins["json-parse"] = func() { OpPush(JSONParse(PopStr("json-parse"))) }
+	Builtins["json-stringify"] = func() { PushStr(JSONStringify(PopExpr("json-stringify"), "")) }
+	Builtins["json-pretty"] = func() { PushStr(JSONStringify(PopExpr("json-pretty"), "  ")) }
+}
+
+type JSONParser struct {
+	data string
+	offset int
+}
+
+func JSONParse(data string) Expr {
+	parser := &JSONParser{data: data}
+	parser.skipSpace()
+	value := parser.parseValue()
+	parser.skipSpace()
+	if parser.offset < len(parser.data) {
+		parser.fail("unexpected '%s' after the value", parser.rest())
+	}
+	return value
+}
+
+// fail raises a JSONError pointing at the current offset.
+func (parser *JSONParser) fail(format string, args ...interface{}) {
+	line, column := 1, 1
+	for _, r := range parser.data[:parser.offset] {
+		if r == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	message := fmt.Sprintf(format, args...)
+	Raise("JSONError", fmt.Sprintf("%s at offset %d (line %d, column %d)", message, parser.offset, line, column))
+}
+
+// rest is a short quote of the input at the current offset.
+func (parser *JSONParser) rest() string {
+	runes := []rune(parser.data[parser.offset:])
+	if len(runes) > 10 {
+		return string(runes[:10]) + "..."
+	}
+	return string(runes)
+}
+
+func (parser *JSONParser) skipSpace() {
+	for parser.offset < len(parser.data) && strings.IndexByte(" \t\r\n", parser.data[parser.offset]) >= 0 {
+		parser.offset++
+	}
+}
+
+func (parser *JSONParser) parseValue() Expr {
+	if parser.offset >= len(parser.data) {
+		parser.fail("unexpected end of JSON")
+	}
+	switch c := parser.data[parser.offset]; {
+		case c == '[':
+			return parser.parseArray()
+		case c == '"':
+			return Expr{Type: ExprStr, AsStr: parser.parseString()}
+		case c == '-' || (c >= '0' && c <= '9'):
+			return parser.parseNumber()
+		case c == '{':
+			parser.fail("JSON objects are not supported, T# has no map type")
+		case strings.HasPrefix(parser.data[parser.offset:], "true"):
+			parser.offset += 4
+			return Expr{Type: ExprBool, AsBool: true}
+		case strings.HasPrefix(parser.data[parser.offset:], "false"):
+			parser.offset += 5
+			return Expr{Type: ExprBool, AsBool: false}
+		case strings.HasPrefix(parser.data[parser.offset:], "null"):
+			parser.fail("null is not supported, T# has no null value")
+	}
+	parser.fail("unexpected '%s'", parser.rest())
+	return Expr{}
+}
+
+func (parser *JSONParser) parseArray() Expr {
+	parser.offset++
+	list := []Expr{}
+	parser.skipSpace()
+	if parser.offset < len(parser.data) && parser.data[parser.offset] == ']' {
+		parser.offset++
+		return Expr{Type: ExprArr, AsArr: list}
+	}
+	for {
+		parser.skipSpace()
+		list = append(list, parser.parseValue())
+		parser.skipSpace()
+		if parser.offset >= len(parser.data) {
+			parser.fail("unexpected end of JSON, expected ',' or ']'")
+		}
+		if parser.data[parser.offset] == ']' {
+			parser.offset++
+			return Expr{Type: ExprArr, AsArr: list}
+		}
+		if parser.data[parser.offset] != ',' {
+			parser.fail("expected ',' or ']' but got '%s'", parser.rest())
+		}
+		parser.offset++
+	}
+}
+
+func (parser *JSONParser) parseString() string {
+	start := parser.offset
+	parser.offset++
+	for parser.offset < len(parser.data) {
+		switch parser.data[parser.offset] {
+			case '"':
+				parser.offset++
+				var value string
+				if err := json.Unmarshal([]byte(parser.data[start:parser.offset]), &value); err != nil {
+					parser.offset = start
+					parser.fail("invalid string")
+				}
+				return value
+			case '\\':
+				parser.offset += 2
+			default:
+				if parser.data[parser.offset] < 0x20 {
+					parser.fail("control character in string")
+				}
+				parser.offset++
+		}
+	}
+	parser.offset = start
+	parser.fail("unterminated string")
+	return ""
+}
+
+func (parser *JSONParser) parseNumber() Expr {
+	start := parser.offset
+	if parser.data[parser.offset] == '-' {
+		parser.offset++
+	}
+	for parser.offset < len(parser.data) && strings.IndexByte("0123456789.eE+-", parser.data[parser.offset]) >= 0 {
+		parser.offset++
+	}
+	number := parser.data[start:parser.offset]
+	digits := strings.TrimPrefix(number, "-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+		parser.offset = start
+		parser.fail("invalid number '%s', JSON numbers have no leading zeros", number)
+	}
+	value, err := strconv.Atoi(number)
+	if err != nil {
+		parser.offset = start
+		if errors.Is(err, strconv.ErrRange) {
+			parser.fail("number %s is out of range for an int", number)
+		}
+		if isFloat(number) {
+			parser.fail("number %s is not an int, T# has no float type", number)
+		}
+		parser.fail("invalid number '%s'", number)
+	}
+	return Expr{Type: ExprInt, AsInt: value}
+}
+
+// JSONStringify encodes expr. A non-empty indent puts each element of
+// a list on its own line.
+func JSONStringify(expr Expr, indent string) string {
+	var builder strings.Builder
+	writeJSON(&builder, expr, indent, "")
+	return builder.String()
+}
+
+func writeJSON(builder *strings.Builder, expr Expr, indent string, prefix string) {
+	switch expr.Type {
+		case ExprInt:
+			builder.WriteString(strconv.Itoa(expr.AsInt))
+		case ExprBool:
+			builder.WriteString(strconv.FormatBool(expr.AsBool))
+		case ExprStr:
+			var buffer bytes.Buffer
+			encoder := json.NewEncoder(&buffer)
+			encoder.SetEscapeHTML(false)
+			encoder.Encode(expr.AsStr)
+			builder.WriteString(strings.TrimSuffix(buffer.String(), "\n"))
+		case ExprArr:
+			if len(expr.AsArr) == 0 {
+				builder.WriteString("[]")
+				return
+			}
+			builder.WriteString("[")
+			for i, item := range expr.AsArr {
+				if i > 0 {
+					builder.WriteString(",")
+				}
+				if indent != "" {
+					builder.WriteString("\n" + prefix + indent)
+				}
+				writeJSON(builder, item, indent, prefix+indent)
+			}
+			if indent != "" {
+				builder.WriteString("\n" + prefix)
+			}
+			builder.WriteString("]")
+		default:
+			Raise("TypeError", fmt.Sprintf("cannot encode <%s> as JSON", TypeName(expr)))
+	}
+}
+
+// Regular expression words, using Go's regexp syntax. Each takes the
+// string and then the pattern.
+func init() {
+	Builtins["match?"] = func() {
+		re, str := PopRegexp("match?"), PopStr("match?")
+		PushBool(re.MatchString(str))
+	}
+	Builtins["find"] = func() {
+		re, str := PopRegexp("find"), PopStr("find")
+		PushStr(re.FindString(str))
+	}
+	Builtins["find-all"] = func() {
+		re, str := PopRegexp("find-all"), PopStr("find-all")
+		PushList(StrList(re.FindAllString(str, -1)))
+	}
+	Builtins["captures"] = func() {
+		re, str := PopRegexp("captures"), PopStr("captures")
+		list := []Expr{}
+		match := re.FindStringSubmatchIndex(str)
+		for i := 0; i < len(match); i += 2 {
+			if match[i] < 0 {
+				// a group that took no part in the match, unlike one
+				// that matched ""
+				list = append(list, Expr{Type: ExprBool, AsBool: false})
+				continue
+			}
+			list = append(list, Expr{Type: ExprStr, AsStr: str[match[i]:match[i+1]]})
+		}
+		PushList(list)
+	}
+	Builtins["regex-replace"] = func() {
+		with, re, str := PopStr("regex-replace"), PopRegexp("regex-replace"), PopStr("regex-replace")
+		PushStr(re.ReplaceAllString(str, with))
+	}
+	Builtins["regex-split"] = func() {
+		re, str := PopRegexp("regex-split"), PopStr("regex-split")
+		PushList(StrList(re.Split(str, -1)))
+	}
+}
+
+// Patterns are compiled once and kept, so a regex word inside a loop
+// does not compile its pattern on every pass. Patterns built at run
+// time could fill it without end, so it starts over once it holds
+// MaxRegexpCache of them.
+var RegexpCache = map[string]*regexp.Regexp{}
+
+const MaxRegexpCache = 256
+
+func PopRegexp(word string) *regexp.Regexp {
+	pattern := PopStr(word)
+	if re, ok := RegexpCache[pattern]; ok {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		var syntaxError *syntax.Error
+		if errors.As(err, &syntaxError) {
+			Raise("RegexError", fmt.Sprintf("bad pattern '%s': %s '%s'", pattern, syntaxError.Code, syntaxError.Expr))
+		}
+		Raise("RegexError", fmt.Sprintf("bad pattern '%s': %s", pattern, err))
+	}
+	if len(RegexpCache) >= MaxRegexpCache {
+		RegexpCache = map[string]*regexp.Regexp{}
+	}
+	RegexpCache[pattern] = re
+	return re
+}
+
+// StrList turns Go strings into a T# list of strings.
+func StrList(strs []string) []Expr {
+	list := []Expr{}
+	for _, str := range strs {
+		list = append(list, Expr{Type: ExprStr, AsStr: str})
+	}
+	return list
+}
+
+func OpBuiltin(expr Expr) {
+	Builtins[expr.AsBuiltin]()
+}
+
+// OpShortCircuit runs the body of 'and-then' only when the top of the
+// stack is true, and the body of 'or-else' only when it is false. The
+// body must leave a bool in place of the one it was given.
+func OpShortCircuit(expr Expr) (Control) {
+	word := "and-then"
+	if expr.Type == ExprOrElse {
+		word = "or-else"
+	}
+	value := PopBool(word)
+	if value == (expr.Type == ExprOrElse) {
+		PushBool(value)
+		return Control{}
+	}
+	depth := len(Stack)
+	control := VisitExpr(expr.AsBody)
+	if control.Kind != ControlNone {
+		return control
+	}
+	if len(Stack) != depth+1 || Stack[len(Stack)-1].Type != ExprBool {
+		Raise("TypeError", fmt.Sprintf("'%s' body must leave one <bool> on the stack", word))
+	}
+	return Control{}
+}
+
+// PopExpr drops the top of the stack and returns it.
+func PopExpr(word string) Expr {
+	if len(Stack) < 1 {
+		Raise("StackError", fmt.Sprintf("'%s' expected more than one element in stack.", word))
+	}
+	visitedExpr := Stack[len(Stack)-1]
+	OpDrop()
+	return visitedExpr
+}
+
+// PopType is PopExpr for words that only take one type.
+func PopType(word string, exprType ExprType, name string) Expr {
+	visitedExpr := PopExpr(word)
+	if visitedExpr.Type != exprType {
+		Raise("TypeError", fmt.Sprintf("'%s' expected type <%s>, got <%s>", word, name, TypeName(visitedExpr)))
+	}
+	return visitedExpr
+}
+
+func PopInt(word string) int {
+	return PopType(word, ExprInt, "int").AsInt
+}
+
+func PopBool(word string) bool {
+	return PopType(word, ExprBool, "bool").AsBool
+}
+
+func PopStr(word string) string {
+	return PopType(word, ExprStr, "string").AsStr
+}
+
+func PopList(word string) []Expr {
+	return PopType(word, ExprArr, "list").AsArr
+}
+
+// PopShift pops a shift count, which must not be negative.
+func PopShift(word string) int {
+	n := PopInt(word)
+	if n < 0 {
+		Raise("ValueError", fmt.Sprintf("'%s' shift count must not be negative", word))
+	}
+	return n
+}
+
+func PushInt(value int) {
+	OpPush(Expr{Type: ExprInt, AsInt: value})
+}
+
+func PushBool(value bool) {
+	OpPush(Expr{Type: ExprBool, AsBool: value})
+}
+
+func PushStr(value string) {
+	OpPush(Expr{Type: ExprStr, AsStr: value})
+}
+
+func PushList(value []Expr) {
+	OpPush(Expr{Type: ExprArr, AsArr: value})
+}
+
+
+// -----------------------------
+// -------- Visit Exprs --------
+// -----------------------------
+
+type ControlKind int
+const (
+	ControlNone ControlKind = iota
+	ControlBreak
+	ControlContinue
+	ControlReturn
+)
+
+// Control tells the enclosing construct why a body stopped early.
+// Label is set for 'break :name' and 'continue :name'.
+type Control struct {
+	Kind ControlKind
+	Label string
+}
+
+func VisitExpr(exprs []Expr) (Control) {
+	control := Control{}
+	for _, expr := range exprs {
+		CurrentPos = expr.Pos
+		if Debug != nil {
+			Debug.Visit(expr)
+		}
+		switch expr.Type {
+			case ExprPush:
+				OpPush(expr.AsPush.Arg)
+			case ExprPrint:
+				OpPrint()
+			case ExprInput:
+				OpInput()
+			case ExprPuts:
+				OpPuts()
+			case ExprPrintS:
+				OpPrintS()
+			case ExprPrintC:
+				OpPrintC()
+			case ExprAppend:
+				OpAppend(expr)
+			case ExprTypeOf:
+				OpTypeOf()
+			case ExprSwap:
+				OpSwap()
+			case ExprOver:
+				OpOver()
+			case ExprRot:
+				OpRot()
+			case ExprInc:
+				OpInc()
+			case ExprDec:
+				OpDec()
+			case ExprImport:
+				OpImport(expr)
+			case ExprDup:
+				OpDup()
+			case ExprDrop:
+				OpDrop()
+			case ExprLen:
+				OpLen()
+			case ExprExit:
+				OpExit()
+			case ExprExitWith:
+				OpExitWith()
+			case ExprBinop:
+				OpBinop(expr.AsBiniop)
+			case ExprCompare:
+				OpCondition(expr)
+			case ExprBlockdef:
+				OpBlockdef(expr)
+			case ExprCall:
+				OpCallBlock(expr)
+			case ExprIf:
+				control = OpIf(expr)
+			case ExprMatch:
+				control = OpMatch(expr)
+			case ExprFor:
+				control = OpFor(expr)
+			case ExprForIn:
+				control = OpForIn(expr)
+			case ExprRange:
+				OpRange()
+			case ExprBuiltin:
+				OpBuiltin(expr)
+			case ExprAndThen, ExprOrElse:
+				control = OpShortCircuit(expr)
+			case ExprVardef:
+				OpVardef(expr)
+			case ExprBreak:
+				control = Control{Kind: ControlBreak, Label: expr.AsLabel}
+			case ExprContinue:
+				control = Control{Kind: ControlContinue, Label: expr.AsLabel}
+			case ExprReturn:
+				control = Control{Kind: ControlReturn}
+			case ExprTry:
+				control = OpTry(expr)
+			case ExprThrow:
+				OpThrow()
+		}
+		if control.Kind != ControlNone {
+			break
+		}
+	}
+	return control
+}
+
+
+// -----------------------------
+// ---------- Formatter --------
+// -----------------------------
+
+// FmtIndent is one level of indentation in formatted source.
+const FmtIndent = "    "
+
+// FmtToken is a token of the source being formatted.
+type FmtToken struct {
+	Pos Position
+	Type Token
+	Value string
+	// Frame is the index of the do...end frame the token opens,
+	// continues or closes, or -1.
+	Frame int
+}
+
+// Text is the token as it is written in the source.
+func (token FmtToken) Text() string {
+	switch token.Type {
+		case TOKEN_STRING:
+			return "\"" + token.Value + "\""
+		case TOKEN_INTERP:
+			return "$\"" + token.Value + "\""
+		case TOKEN_LABEL:
+			return ":" + token.Value
+		case TOKEN_COMMENT:
+			return "#" + strings.TrimRightFunc(token.Value, unicode.IsSpace)
+	}
+	return token.Value
+}
+
+// EndLine is the line the token ends on, past any newlines written
+// inside a string.
+func (token FmtToken) EndLine() int {
+	return token.Pos.line + strings.Count(token.Value, "\n")
+}
+
+func (token FmtToken) is(words ...string) bool {
+	if token.Type == TOKEN_STRING || token.Type == TOKEN_INTERP || token.Type == TOKEN_COMMENT || token.Type == TOKEN_LABEL {
+		return false
+	}
+	for _, word := range words {
+		if token.Value == word {
+			return true
+		}
+	}
+	return false
+}
+
+// LexAll returns every token of src, comments included.
+func LexAll(src string) []FmtToken {
+	lexer := LexerInit(strings.NewReader(src))
+	lexer.comments = true
+	tokens := []FmtToken{}
+	for {
+		pos, tok, val := lexer.Lex()
+		if tok == TOKEN_EOF {
+			return tokens
+		}
+		tokens = append(tokens, FmtToken{Pos: pos, Type: tok, Value: val, Frame: -1})
+	}
+}
+
+// fmtFrame is a body that ends with 'end': it is opened by 'do',
+// 'try', 'and-then' or 'or-else'.
+type fmtFrame struct {
+	open int
+	close int
+	// elif is set between 'elif' and its 'do', which continues the
+	// frame instead of opening one.
+	elif bool
+}
+
+// matchFrames links the tokens that open, continue and close each
+// frame, so the formatter knows which bodies span several lines.
+func matchFrames(tokens []FmtToken) []fmtFrame {
+	frames := []fmtFrame{}
+	stack := []int{}
+	for i := range tokens {
+		token := &tokens[i]
+		top := -1
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		switch {
+			case token.Type == TOKEN_DO && top >= 0 && frames[top].elif:
+				frames[top].elif = false
+				token.Frame = top
+			case token.Type == TOKEN_DO || token.is("try", "and-then", "or-else"):
+				frames = append(frames, fmtFrame{open: i, close: -1})
+				stack = append(stack, len(frames)-1)
+				token.Frame = len(frames) - 1
+			case token.Type == TOKEN_ELIF && top >= 0:
+				frames[top].elif = true
+				token.Frame = top
+			case (token.Type == TOKEN_ELSE || token.Type == TOKEN_CATCH || token.Type == TOKEN_FINALLY) && top >= 0:
+				token.Frame = top
+			case token.Type == TOKEN_END && top >= 0:
+				frames[top].close = i
+				stack = stack[:len(stack)-1]
+				token.Frame = top
+		}
+	}
+	return frames
+}
+
+// FormatSource prints T# source in its canonical layout: bodies
+// indented four spaces, a multi-line body's 'do', 'else' and 'end' on
+// lines of their own, single spaces between tokens, list literals
+// written as [a, b], and at most one blank line in a row. Comments
+// and the remaining line breaks are kept. src must parse.
+func FormatSource(src string) string {
+	tokens := LexAll(src)
+	frames := matchFrames(tokens)
+	multiline := func(token FmtToken) bool {
+		if token.Frame < 0 {
+			return false
+		}
+		frame := frames[token.Frame]
+		return frame.close >= 0 && tokens[frame.open].Pos.line != tokens[frame.close].Pos.line
+	}
+	// breakBefore and breakAfter are the tokens that must start or end
+	// a line because the body around them spans several.
+	breakBefore := func(token FmtToken) bool {
+		return multiline(token) && (token.Type == TOKEN_END || token.Type == TOKEN_ELSE || token.Type == TOKEN_ELIF || token.Type == TOKEN_CATCH || token.Type == TOKEN_FINALLY)
+	}
+	breakAfter := func(token FmtToken) bool {
+		return multiline(token) && token.Type != TOKEN_ELIF
+	}
+	dedent := func(token FmtToken) bool {
+		return token.Frame >= 0 && (token.Type == TOKEN_END || token.Type == TOKEN_ELSE || token.Type == TOKEN_ELIF || token.Type == TOKEN_CATCH || token.Type == TOKEN_FINALLY)
+	}
+
+	var out strings.Builder
+	depth := 0
+	brackets := 0
+	line := []string{}
+	lineStart := 0
+	flush := func() {
+		if len(line) > 0 {
+			indent := lineStart
+			if indent < 0 {
+				indent = 0
+			}
+			out.WriteString(strings.Repeat(FmtIndent, indent))
+			out.WriteString(strings.Join(line, ""))
+			out.WriteString("\n")
+		}
+		line = nil
+	}
+	for i, token := range tokens {
+		var prev *FmtToken
+		if i > 0 {
+			prev = &tokens[i-1]
+		}
+		newLine := prev == nil || token.Pos.line != prev.EndLine() || breakBefore(token) && len(line) > 0 || breakAfter(*prev) && token.Type != TOKEN_COMMENT
+		if newLine {
+			flush()
+			if prev != nil && token.Pos.line > prev.EndLine() + 1 && out.Len() > 0 {
+				out.WriteString("\n")
+			}
+			lineStart = depth + brackets
+			if dedent(token) || token.Type == TOKEN_R_BRACKET {
+				lineStart--
+			}
+		} else {
+			switch {
+				case token.Type == TOKEN_COMMA || token.Type == TOKEN_R_BRACKET || token.Type == TOKEN_DOT || prev.Type == TOKEN_DOT:
+				case prev.Type == TOKEN_L_BRACKET:
+				case token.Type == TOKEN_L_BRACKET && (prev.Type == TOKEN_ID || prev.Type == TOKEN_R_BRACKET) &&
+					prev.Pos.column + utf8.RuneCountInString(prev.Text()) == token.Pos.column:
+					// an index like xs[0] stays attached
+				default:
+					line = append(line, " ")
+			}
+		}
+		line = append(line, token.Text())
+		switch {
+			case token.Type == TOKEN_L_BRACKET:
+				brackets++
+			case token.Type == TOKEN_R_BRACKET:
+				brackets--
+			case token.Type == TOKEN_END && token.Frame >= 0:
+				depth--
+			case token.Frame >= 0 && tokens[frames[token.Frame].open].Pos == token.Pos:
+				depth++
+		}
+	}
+	flush()
+	return out.String()
+}
+
+// CheckSyntax parses src and returns the syntax error it has, if any.
+func CheckSyntax(src string) (err *Exception) {
+	defer func() {
+		if r := recover(); r != nil {
+			if exception, ok := r.(*Exception); ok {
+				err = exception
+				return
+			}
+			panic(r)
+		}
+	}()
+	ParserParse(ParserInit(LexerInit(strings.NewReader(src))))
+	return nil
+}
+
+// SameTokens reports whether a and b lex to the same tokens, which is
+// all the formatter may change.
+func SameTokens(a string, b string) bool {
+	x, y := LexAll(a), LexAll(b)
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if x[i].Type != y[i].Type || x[i].Text() != y[i].Text() {
+			return false
+		}
+	}
+	return true
+}
+
+// SourceFiles expands the arguments of a tool into .t# files: a
+// directory stands for the .t# files below it, leaving out hidden
+// directories and installed packages.
+func SourceFiles(args []string) ([]string, error) {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	files := []string{}
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() && path != arg && (strings.HasPrefix(entry.Name(), ".") || entry.Name() == ModulesDir) {
+				return filepath.SkipDir
+			}
+			if !entry.IsDir() && strings.HasSuffix(path, ".t#") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// FmtCommand implements 'tsh fmt': formatted source on standard
+// output, or with --check the files that are not formatted, or with
+// --write the files rewritten in place.
+func FmtCommand(args []string) int {
+	mode := ""
+	if len(args) > 0 && (args[0] == "--check" || args[0] == "--write") {
+		mode = args[0]
+		args = args[1:]
+	}
+	files, err := SourceFiles(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+		return ExitNoInput
+	}
+	status := ExitOK
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+			status = ExitNoInput
+			continue
+		}
+		if exception := CheckSyntax(string(src)); exception != nil {
+			Out.Flush()
+			fmt.Fprintln(os.Stderr, file + ":" + exception.Error())
+			status = ExitSyntaxError
+			continue
+		}
+		formatted := FormatSource(string(src))
+		if !SameTokens(string(src), formatted) {
+			Out.Flush()
+			fmt.Fprintln(os.Stderr, "Error: formatting '" + file + "' would change its meaning")
+			status = ExitRuntimeError
+			continue
+		}
+		switch mode {
+			case "--check":
+				if formatted != string(src) {
+					fmt.Fprintln(Out, file)
+					if status == ExitOK {
+						status = ExitRuntimeError
+					}
+				}
+			case "--write":
+				if formatted != string(src) {
+					if err := os.WriteFile(file, []byte(formatted), 0644); err != nil {
+						fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+						status = ExitRuntimeError
+					}
+				}
+			default:
+				fmt.Fprint(Out, formatted)
+		}
+	}
+	return status
+}
+
+
+// -----------------------------
+// ----------- Linter ----------
+// -----------------------------
+
+// Diagnostic is a problem found in a source file by the linter.
+type Diagnostic struct {
+	File string `json:"file"`
+	Line int `json:"line"`
+	Column int `json:"column"`
+	Rule string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func (diagnostic Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", diagnostic.File, diagnostic.Line, diagnostic.Column, diagnostic.Rule, diagnostic.Message)
+}
+
+// LintRule is a check 'tsh lint' runs unless it is disabled.
+type LintRule struct {
+	Name string
+	Doc string
+	Check func(linter *Linter)
+}
+
+var LintRules = []LintRule{
+	{"unused-variable", "a variable is assigned with '->' but never read", LintUnusedVariable},
+	{"unused-block", "a block is defined but never called or exported", LintUnusedBlock},
+	{"unreachable-code", "code follows 'exit', 'break', 'continue', 'return' or 'throw' in the same body", LintUnreachable},
+	{"redefined-block", "a block is defined twice, in this file or by its imports", LintRedefinedBlock},
+	{"assign-keeps-value", "'-> name' is not followed by 'drop', so the value stays on the stack", LintAssignKeepsValue},
+}
+
+// Linter holds one file while the rules look at it.
+type Linter struct {
+	File string
+	Exprs []Expr
+	Diagnostics []Diagnostic
+	rule string
+}
+
+func (linter *Linter) Report(pos Position, format string, a ...interface{}) {
+	linter.Diagnostics = append(linter.Diagnostics, Diagnostic{
+		File: linter.File,
+		Line: pos.line,
+		Column: pos.column,
+		Rule: linter.rule,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// WalkBodies calls visit for exprs and for every body nested in it.
+func WalkBodies(exprs []Expr, visit func(body []Expr)) {
+	visit(exprs)
+	for _, expr := range exprs {
+		for _, body := range SubBodies(expr) {
+			WalkBodies(body, visit)
+		}
+	}
+}
+
+// WalkExprs calls visit for every expr in exprs, nested ones included,
+// in source order.
+func WalkExprs(exprs []Expr, visit func(expr Expr)) {
+	for _, expr := range exprs {
+		visit(expr)
+		for _, body := range SubBodies(expr) {
+			WalkExprs(body, visit)
+		}
+	}
+}
+
+// SubBodies lists the exprs nested in expr: bodies, conditions, list
+// elements and indexes.
+func SubBodies(expr Expr) [][]Expr {
+	bodies := [][]Expr{}
+	switch expr.Type {
+		case ExprPush:
+			bodies = append(bodies, []Expr{expr.AsPush.Arg})
+		case ExprArr:
+			bodies = append(bodies, expr.AsArr)
+		case ExprId:
+			bodies = append(bodies, expr.AsId.Index)
+		case ExprAppend:
+			bodies = append(bodies, expr.AsAppend.Index)
+		case ExprBlockdef:
+			bodies = append(bodies, expr.AsBlockdef.Body)
+		case ExprIf:
+			bodies = append(bodies, expr.AsIf.Op, expr.AsIf.Body)
+			for _, elif := range expr.AsIf.Elifs {
+				bodies = append(bodies, elif.Op, elif.Body)
+			}
+			bodies = append(bodies, expr.AsIf.ElseBody)
+		case ExprFor, ExprForIn:
+			bodies = append(bodies, expr.AsFor.Op, expr.AsFor.Body)
+		case ExprTry:
+			bodies = append(bodies, expr.AsTry.Body, expr.AsTry.CatchBody, expr.AsTry.FinallyBody)
+		case ExprMatch:
+			bodies = append(bodies, expr.AsMatch.Op)
+			for _, c := range expr.AsMatch.Cases {
+				bodies = append(bodies, []Expr{c.Pattern}, c.Body)
+			}
+			bodies = append(bodies, expr.AsMatch.Default)
+		case ExprAndThen, ExprOrElse:
+			bodies = append(bodies, expr.AsBody)
+	}
+	return bodies
+}
+
+// templateVars are the variables a format template reads, such as
+// 'x' in "{x:>5}".
+func templateVars(template string) (names []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*Exception); !ok {
+				panic(r)
+			}
+		}
+	}()
+	for _, part := range ParseTemplate(template) {
+		if !part.IsText && part.Name != "" {
+			names = append(names, PlaceholderVar(part.Name).AsId.Name)
+		}
+	}
+	return names
+}
+
+func LintUnusedVariable(linter *Linter) {
+	read := map[string]bool{}
+	WalkBodies(linter.Exprs, func(body []Expr) {
+		for i, expr := range body {
+			switch expr.Type {
+				case ExprId:
+					read[expr.AsId.Name] = true
+				case ExprInterp:
+					for _, name := range templateVars(expr.AsStr) {
+						read[name] = true
+					}
+				case ExprPush:
+					// "{x}" format reads x
+					if expr.AsPush.Arg.Type == ExprStr && i+1 < len(body) && body[i+1].Type == ExprBuiltin && (body[i+1].AsBuiltin == "format" || body[i+1].AsBuiltin == "printf") {
+						for _, name := range templateVars(expr.AsPush.Arg.AsStr) {
+							read[name] = true
+						}
+					}
+			}
+		}
+	})
+	reported := map[string]bool{}
+	WalkExprs(linter.Exprs, func(expr Expr) {
+		name := ""
+		if expr.Type == ExprVardef {
+			name = expr.AsVardef.Name
+		} else if expr.Type == ExprForIn {
+			name = expr.AsFor.Var
+		}
+		if name == "" || strings.HasPrefix(name, "_") || read[name] || reported[name] {
+			return
+		}
+		reported[name] = true
+		linter.Report(expr.Pos, "variable '%s' is assigned but never read", name)
+	})
+}
+
+func LintUnusedBlock(linter *Linter) {
+	called := map[string]bool{}
+	WalkExprs(linter.Exprs, func(expr Expr) {
+		if expr.Type == ExprCall && expr.AsCall.Module == "" {
+			called[expr.AsCall.Value] = true
+		}
+	})
+	WalkExprs(linter.Exprs, func(expr Expr) {
+		if expr.Type == ExprBlockdef && !expr.AsBlockdef.Exported && !called[expr.AsBlockdef.Name] {
+			linter.Report(expr.Pos, "block '%s' is never called", expr.AsBlockdef.Name)
+		}
+	})
+}
+
+func LintUnreachable(linter *Linter) {
+	words := map[ExprType]string{ExprExit: "exit", ExprExitWith: "exit-with", ExprBreak: "break", ExprContinue: "continue", ExprReturn: "return", ExprThrow: "throw"}
+	WalkBodies(linter.Exprs, func(body []Expr) {
+		for i, expr := range body {
+			if word, ok := words[expr.Type]; ok && i+1 < len(body) {
+				linter.Report(body[i+1].Pos, "unreachable code after '%s'", word)
+				return
+			}
+		}
+	})
+}
+
+func LintAssignKeepsValue(linter *Linter) {
+	WalkBodies(linter.Exprs, func(body []Expr) {
+		for i, expr := range body {
+			if expr.Type != ExprVardef || i+1 == len(body) {
+				continue
+			}
+			if next := body[i+1].Type; next != ExprDrop && next != ExprVardef {
+				linter.Report(expr.Pos, "'-> %s' leaves the value on the stack, add 'drop' if it is not used", expr.AsVardef.Name)
+			}
+		}
+	})
+}
+
+// blockSite is where a block is defined, as the linter reports it.
+type blockSite struct {
+	name string
+	where string
+}
+
+// importedBlocks lists the blocks a plain import brings into scope:
+// those of the file and of its own plain imports, skipping files in
+// seen. Files that cannot be read or parsed are skipped; running the
+// program reports those.
+func importedBlocks(imp *Import, seen map[string]bool) (sites []blockSite) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(*Exception); !ok {
+				panic(r)
+			}
+		}
+	}()
+	path := ResolveImport(imp.Path, imp.From)
+	if seen[path] {
+		return nil
+	}
+	seen[path] = true
+	file, err := OpenImport(path)
+	if err != nil {
+		return nil
+	}
+	parser := ParserInit(LexerInit(file))
+	parser.file = path
+	exprs, _ := ParserParse(parser)
+	file.Close()
+	WalkExprs(exprs, func(expr Expr) {
+		if expr.Type == ExprBlockdef {
+			sites = append(sites, blockSite{expr.AsBlockdef.Name, fmt.Sprintf("%s:%d", DisplayPath(path), expr.Pos.line)})
+		} else if expr.Type == ExprImport && expr.AsImport.Alias == "" {
+			sites = append(sites, importedBlocks(expr.AsImport, seen)...)
+		}
+	})
+	return sites
+}
+
+func LintRedefinedBlock(linter *Linter) {
+	defined := map[string]string{}
+	seen := map[string]bool{}
+	if abs, err := filepath.Abs(linter.File); err == nil {
+		seen[abs] = true
+	}
+	WalkExprs(linter.Exprs, func(expr Expr) {
+		if expr.Type == ExprBlockdef {
+			name := expr.AsBlockdef.Name
+			if where, ok := defined[name]; ok {
+				linter.Report(expr.Pos, "block '%s' is already defined at %s", name, where)
+				return
+			}
+			defined[name] = fmt.Sprintf("line %d", expr.Pos.line)
+		} else if expr.Type == ExprImport && expr.AsImport.Alias == "" {
+			for _, site := range importedBlocks(expr.AsImport, seen) {
+				if where, ok := defined[site.name]; ok {
+					linter.Report(expr.Pos, "block '%s' from %s is already defined at %s", site.name, site.where, where)
+					continue
+				}
+				defined[site.name] = site.where
+			}
+		}
+	})
+}
+
+// lintIgnores reads the '# lint:ignore [rule,...]' comments of src. A
+// comment on a line of its own covers the next line, a trailing one
+// its own line. No rule names means every rule.
+func lintIgnores(src string) map[int][]string {
+	ignores := map[int][]string{}
+	tokens := LexAll(src)
+	for i, token := range tokens {
+		if token.Type != TOKEN_COMMENT {
+			continue
+		}
+		text := strings.TrimSpace(token.Value)
+		if !strings.HasPrefix(text, "lint:ignore") {
+			continue
+		}
+		line := token.Pos.line
+		if i == 0 || tokens[i-1].Pos.line != line {
+			line++
+		}
+		rules := strings.FieldsFunc(strings.TrimPrefix(text, "lint:ignore"), func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		if len(rules) == 0 {
+			rules = []string{"*"}
+		}
+		ignores[line] = append(ignores[line], rules...)
+	}
+	return ignores
+}
+
+// LintSource runs the enabled rules on the source of file. A syntax
+// error is returned as the only diagnostic, with the rule "syntax".
+func LintSource(file string, src string, enabled map[string]bool) []Diagnostic {
+	if exception := CheckSyntax(src); exception != nil {
+		return []Diagnostic{{File: file, Line: exception.Pos.line, Column: exception.Pos.column, Rule: "syntax", Message: exception.Message}}
+	}
+	parser := ParserInit(LexerInit(strings.NewReader(src)))
+	parser.file = file
+	exprs, _ := ParserParse(parser)
+	linter := &Linter{File: file, Exprs: exprs}
+	for _, rule := range LintRules {
+		if enabled[rule.Name] {
+			linter.rule = rule.Name
+			rule.Check(linter)
+		}
+	}
+	ignores := lintIgnores(src)
+	diagnostics := []Diagnostic{}
+	for _, diagnostic := range linter.Diagnostics {
+		ignored := false
+		for _, rule := range ignores[diagnostic.Line] {
+			ignored = ignored || rule == "*" || rule == diagnostic.Rule
+		}
+		if !ignored {
+			diagnostics = append(diagnostics, diagnostic)
+		}
+	}
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].Line != diagnostics[j].Line {
+			return diagnostics[i].Line < diagnostics[j].Line
+		}
+		return diagnostics[i].Column < diagnostics[j].Column
+	})
+	return diagnostics
+}
+
+// LintCommand implements 'tsh lint': the diagnostics of the given
+// files as file:line:col lines or as JSON. It exits with 1 when it
+// finds anything.
+func LintCommand(args []string) int {
+	format := "text"
+	enabled := map[string]bool{}
+	for _, rule := range LintRules {
+		enabled[rule.Name] = true
+	}
+	setRules := func(list string, on bool) bool {
+		for _, name := range strings.Split(list, ",") {
+			if _, ok := enabled[name]; !ok {
+				fmt.Fprintln(os.Stderr, "Error: unknown lint rule '" + name + "'")
+				return false
+			}
+			enabled[name] = on
+		}
+		return true
+	}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		flag, value := args[0], ""
+		if eq := strings.Index(flag, "="); eq >= 0 {
+			flag, value = flag[:eq], flag[eq+1:]
+		} else if len(args) > 1 && (flag == "--format" || flag == "--enable" || flag == "--disable") {
+			value = args[1]
+			args = args[1:]
+		}
+		args = args[1:]
+		switch flag {
+			case "--rules":
+				for _, rule := range LintRules {
+					fmt.Fprintf(Out, "%-20s %s\n", rule.Name, rule.Doc)
+				}
+				return ExitOK
+			case "--format":
+				if value != "text" && value != "json" {
+					fmt.Fprintln(os.Stderr, "Error: --format expected 'text' or 'json'")
+					return ExitUsage
+				}
+				format = value
+			case "--enable":
+				// only the listed rules
+				for name := range enabled {
+					enabled[name] = false
+				}
+				if !setRules(value, true) {
+					return ExitUsage
+				}
+			case "--disable":
+				if !setRules(value, false) {
+					return ExitUsage
+				}
+			default:
+				fmt.Fprintln(os.Stderr, "Error: unknown flag '" + flag + "'")
+				return ExitUsage
+		}
+	}
+	files, err := SourceFiles(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+		return ExitNoInput
+	}
+	diagnostics := []Diagnostic{}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+			return ExitNoInput
+		}
+		InitSearchPath(file)
+		diagnostics = append(diagnostics, LintSource(file, string(src), enabled)...)
+	}
+	if format == "json" {
+		data, _ := json.MarshalIndent(diagnostics, "", "  ")
+		fmt.Fprintln(Out, string(data))
+	} else {
+		for _, diagnostic := range diagnostics {
+			fmt.Fprintln(Out, diagnostic)
+		}
+	}
+	if len(diagnostics) > 0 {
+		return ExitRuntimeError
+	}
+	return ExitOK
+}
+
+
+// -----------------------------
+// ------------ LSP ------------
+// -----------------------------
+
+// Keywords are the words the parser handles itself, as opposed to
+// Builtins.
+var Keywords = []string{
+	"and-then", "append", "as", "block", "break", "call", "case", "catch",
+	"continue", "dec", "default", "do", "drop", "dup", "elif", "else", "end",
+	"exit", "exit-with", "export", "false", "finally", "for", "if", "import", "in", "inc",
+	"input", "len", "match", "or-else", "over", "print", "printC", "printS",
+	"puts", "range", "return", "rot", "swap", "throw", "true", "try", "typeof",
+	"string", "int", "bool", "type", "list",
+}
+
+func isWord(name string) bool {
+	if _, ok := Builtins[name]; ok {
+		return true
+	}
+	for _, keyword := range Keywords {
+		if keyword == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceRef is a use of a name in the source: a block or variable
+// definition, a call, or a read of a variable.
+type SourceRef struct {
+	Name string
+	// Module is the alias of a qualified call like 'call m.name'.
+	Module string
+	Block bool
+	Def bool
+	Token FmtToken
+}
+
+// SourceRefs finds the names defined and used in tokens.
+func SourceRefs(tokens []FmtToken) []SourceRef {
+	code := []FmtToken{}
+	for _, token := range tokens {
+		if token.Type != TOKEN_COMMENT {
+			code = append(code, token)
+		}
+	}
+	id := func(i int) bool {
+		return i < len(code) && code[i].Type == TOKEN_ID
+	}
+	refs := []SourceRef{}
+	for i := 0; i < len(code); i++ {
+		token := code[i]
+		switch {
+			case token.is("block") && id(i+1):
+				refs = append(refs, SourceRef{Name: code[i+1].Value, Block: true, Def: true, Token: code[i+1]})
+				i++
+			case token.is("call") && id(i+1):
+				if i+3 < len(code) && code[i+2].Type == TOKEN_DOT && id(i+3) {
+					refs = append(refs, SourceRef{Name: code[i+3].Value, Module: code[i+1].Value, Block: true, Token: code[i+3]})
+					i += 3
+				} else {
+					refs = append(refs, SourceRef{Name: code[i+1].Value, Block: true, Token: code[i+1]})
+					i++
+				}
+			case token.Type == TOKEN_EQUALS && id(i+1):
+				refs = append(refs, SourceRef{Name: code[i+1].Value, Def: true, Token: code[i+1]})
+				i++
+			case token.is("for"):
+				j := i + 1
+				if j < len(code) && code[j].Type == TOKEN_LABEL {
+					j++
+				}
+				if id(j) && id(j+1) && code[j+1].Value == "in" {
+					refs = append(refs, SourceRef{Name: code[j].Value, Def: true, Token: code[j]})
+					i = j + 1
+				}
+			case token.is("as") && id(i+1):
+				i++
+			case token.Type == TOKEN_ID && token.Value != "_" && !isWord(token.Value):
+				refs = append(refs, SourceRef{Name: token.Value, Token: token})
+		}
+	}
+	return refs
+}
+
+// LspPosition is a position in a document as LSP counts it: from
+// zero, in UTF-16 code units.
+type LspPosition struct {
+	Line int `json:"line"`
+	Character int `json:"character"`
+}
+
+type LspRange struct {
+	Start LspPosition `json:"start"`
+	End LspPosition `json:"end"`
+}
+
+type LspLocation struct {
+	URI string `json:"uri"`
+	Range LspRange `json:"range"`
+}
+
+// LspDocument is a document open in the editor.
+type LspDocument struct {
+	URI string
+	Path string
+	Text string
+	lines []string
+}
+
+func NewLspDocument(uri string, text string) *LspDocument {
+	path := uri
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		path = filepath.FromSlash(u.Path)
+	}
+	return &LspDocument{URI: uri, Path: path, Text: text, lines: strings.Split(text, "\n")}
+}
+
+func PathURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// ToLsp converts a 1-based line and rune column of the lexer.
+func (doc *LspDocument) ToLsp(line int, column int) LspPosition {
+	pos := LspPosition{Line: line - 1}
+	if line-1 < len(doc.lines) && line-1 >= 0 {
+		for i, r := range []rune(doc.lines[line-1]) {
+			if i >= column-1 {
+				break
+			}
+			pos.Character += len(utf16.Encode([]rune{r}))
+		}
+	}
+	return pos
+}
+
+// FromLsp converts an LSP position to the lexer's line and column.
+func (doc *LspDocument) FromLsp(pos LspPosition) (int, int) {
+	column := 1
+	if pos.Line >= 0 && pos.Line < len(doc.lines) {
+		units := 0
+		for _, r := range []rune(doc.lines[pos.Line]) {
+			if units >= pos.Character {
+				break
+			}
+			units += len(utf16.Encode([]rune{r}))
+			column++
+		}
+	}
+	return pos.Line + 1, column
+}
+
+func (doc *LspDocument) TokenRange(token FmtToken) LspRange {
+	return LspRange{
+		Start: doc.ToLsp(token.Pos.line, token.Pos.column),
+		End: doc.ToLsp(token.Pos.line, token.Pos.column + utf8.RuneCountInString(token.Text())),
+	}
+}
+
+// TokenAt is the token under the cursor, if any.
+func (doc *LspDocument) TokenAt(pos LspPosition) (FmtToken, bool) {
+	line, column := doc.FromLsp(pos)
+	for _, token := range LexAll(doc.Text) {
+		end := token.Pos.column + utf8.RuneCountInString(token.Text())
+		if token.Pos.line == line && token.Pos.column <= column && column <= end && token.Type != TOKEN_COMMENT {
+			return token, true
+		}
+	}
+	return FmtToken{}, false
+}
+
+// RefAt is the reference under the cursor, if any.
+func (doc *LspDocument) RefAt(pos LspPosition) (SourceRef, bool) {
+	token, ok := doc.TokenAt(pos)
+	if !ok {
+		return SourceRef{}, false
+	}
+	for _, ref := range SourceRefs(LexAll(doc.Text)) {
+		if ref.Token.Pos == token.Pos {
+			return ref, true
+		}
+	}
+	return SourceRef{}, false
+}
+
+// LspBlock is where a block is defined and what its doc comment says.
+// URI is empty for the standard library, which has no file to open.
+type LspBlock struct {
+	URI string
+	Doc *LspDocument
+	Token FmtToken
+	Info BlockDoc
+}
+
+// findBlock looks for the definition of name in src: its token and its
+// doc comment.
+func findBlock(src string, name string) (FmtToken, BlockDoc, bool) {
+	for _, ref := range SourceRefs(LexAll(src)) {
+		if ref.Block && ref.Def && ref.Name == name {
+			_, docs := ParseDocs(src)
+			for _, info := range docs {
+				if info.Name == name && info.Line == ref.Token.Pos.line {
+					return ref.Token, info, true
+				}
+			}
+			return ref.Token, BlockDoc{Name: name}, true
+		}
+	}
+	return FmtToken{}, BlockDoc{}, false
+}
+
+// importSource reads an import of doc, resolved the way the
+// interpreter would resolve it.
+func (doc *LspDocument) importSource(path string) (resolved string, src string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isException := r.(*Exception); !isException {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	resolved = ResolveImport(path, doc.Path)
+	file, err := OpenImport(resolved)
+	if err != nil {
+		return "", "", false
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	return resolved, string(data), err == nil
+}
+
+// blockInModule finds name in the module at resolved, whose source is src.
+func blockInModule(resolved string, src string, name string) (LspBlock, bool) {
+	token, info, ok := findBlock(src, name)
+	if !ok {
+		return LspBlock{}, false
+	}
+	block := LspBlock{Token: token, Info: info}
+	if !strings.HasPrefix(resolved, "std/") {
+		block.URI = PathURI(resolved)
+		block.Doc = NewLspDocument(block.URI, src)
+	}
+	return block, true
+}
+
+// imports lists the imports of doc as path and alias.
+func (doc *LspDocument) imports() [][2]string {
+	code := []FmtToken{}
+	for _, token := range LexAll(doc.Text) {
+		if token.Type != TOKEN_COMMENT {
+			code = append(code, token)
+		}
+	}
+	imports := [][2]string{}
+	for i := 0; i+1 < len(code); i++ {
+		if code[i].is("import") && code[i+1].Type == TOKEN_STRING {
+			alias := ""
+			if i+3 < len(code) && code[i+2].is("as") && code[i+3].Type == TOKEN_ID {
+				alias = code[i+3].Value
+			}
+			imports = append(imports, [2]string{code[i+1].Value, alias})
+		}
+	}
+	return imports
+}
+
+// FindBlock resolves a block reference: in doc, in its plain imports,
+// or in the module a qualified call names.
+func (doc *LspDocument) FindBlock(ref SourceRef) (LspBlock, bool) {
+	if ref.Module == "" {
+		if token, info, ok := findBlock(doc.Text, ref.Name); ok {
+			return LspBlock{URI: doc.URI, Doc: doc, Token: token, Info: info}, true
+		}
+	}
+	for _, imp := range doc.imports() {
+		if imp[1] != ref.Module {
+			continue
+		}
+		if resolved, src, ok := doc.importSource(imp[0]); ok {
+			if block, ok := blockInModule(resolved, src, ref.Name); ok {
+				return block, true
+			}
+		}
+	}
+	return LspBlock{}, false
+}
+
+func (doc *LspDocument) Diagnostics() []map[string]interface{} {
+	enabled := map[string]bool{}
+	for _, rule := range LintRules {
+		enabled[rule.Name] = true
+	}
+	var manifest *Manifest
+	if root, ok := FindProject(filepath.Dir(doc.Path)); ok {
+		manifest, _ = ParseManifest(filepath.Join(root, ManifestFile))
+	}
+	SearchPath = ProjectSearchPath(doc.Path, manifest)
+	tokens := LexAll(doc.Text)
+	diagnostics := []map[string]interface{}{}
+	for _, diagnostic := range LintSource(doc.Path, doc.Text, enabled) {
+		start := doc.ToLsp(diagnostic.Line, diagnostic.Column)
+		end := LspPosition{Line: start.Line, Character: start.Character + 1}
+		for _, token := range tokens {
+			if token.Pos.line == diagnostic.Line && token.Pos.column == diagnostic.Column {
+				end = doc.TokenRange(token).End
+			}
+		}
+		severity := 2
+		if diagnostic.Rule == "syntax" {
+			severity = 1
+		}
+		diagnostics = append(diagnostics, map[string]interface{}{
+			"range": LspRange{Start: start, End: end},
+			"severity": severity,
+			"code": diagnostic.Rule,
+			"source": "tsh",
+			"message": diagnostic.Message,
+		})
+	}
+	return diagnostics
+}
+
+// LspServer answers an editor speaking the Language Server Protocol
+// over standard input and output.
+type LspServer struct {
+	in *bufio.Reader
+	out io.Writer
+	docs map[string]*LspDocument
+	shutdown bool
+}
+
+type lspRequest struct {
+	ID *json.RawMessage `json:"id"`
+	Method string `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspTextDocumentParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	Position LspPosition `json:"position"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+	Context struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+// ReadMessage reads one message framed by a Content-Length header.
+func ReadMessage(in *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "Content-Length:") {
+			value := strings.TrimPrefix(line, "Content-Length:")
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("bad Content-Length '%s'", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(in, body)
+	return body, err
+}
+
+// WriteMessage sends message framed by a Content-Length header.
+func WriteMessage(out io.Writer, message interface{}) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	if flusher, ok := out.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+}
+
+func (server *LspServer) reply(id *json.RawMessage, result interface{}) {
+	WriteMessage(server.out, map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+func (server *LspServer) fail(id *json.RawMessage, code int, message string) {
+	WriteMessage(server.out, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id": id,
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+func (server *LspServer) notify(method string, params interface{}) {
+	WriteMessage(server.out, map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (server *LspServer) publish(doc *LspDocument) {
+	server.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri": doc.URI,
+		"diagnostics": doc.Diagnostics(),
+	})
+}
+
+// Serve handles messages until 'exit' and returns the exit status.
+func (server *LspServer) Serve() int {
+	for {
+		body, err := ReadMessage(server.in)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, "tsh lsp: " + err.Error())
+			}
+			return ExitRuntimeError
+		}
+		var request lspRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			server.fail(nil, -32700, err.Error())
+			continue
+		}
+		if request.Method == "exit" {
+			if server.shutdown {
+				return ExitOK
+			}
+			return ExitRuntimeError
+		}
+		server.handle(request)
+	}
+}
+
+// handle answers one message. A request that makes the server fail
+// gets an internal error back instead of ending the session.
+func (server *LspServer) handle(request lspRequest) {
+	defer func() {
+		if r := recover(); r != nil {
+			if request.ID != nil {
+				server.fail(request.ID, -32603, fmt.Sprintf("internal error: %v", r))
+			}
+		}
+	}()
+	var params lspTextDocumentParams
+	json.Unmarshal(request.Params, &params)
+	doc := server.docs[params.TextDocument.URI]
+	if doc == nil && strings.HasPrefix(request.Method, "textDocument/") && request.Method != "textDocument/didOpen" {
+		if request.ID != nil {
+			server.fail(request.ID, -32602, "document is not open: " + params.TextDocument.URI)
+		}
+		return
+	}
+	switch request.Method {
+		case "initialize":
+			server.reply(request.ID, map[string]interface{}{
+				"capabilities": map[string]interface{}{
+					"textDocumentSync": 1,
+					"definitionProvider": true,
+					"referencesProvider": true,
+					"hoverProvider": true,
+					"completionProvider": map[string]interface{}{"triggerCharacters": []string{"."}},
+					"documentSymbolProvider": true,
+					"documentFormattingProvider": true,
+				},
+				"serverInfo": map[string]interface{}{"name": "tsh"},
+			})
+		case "initialized":
+		case "shutdown":
+			server.shutdown = true
+			server.reply(request.ID, nil)
+		case "textDocument/didOpen":
+			doc = NewLspDocument(params.TextDocument.URI, params.TextDocument.Text)
+			server.docs[doc.URI] = doc
+			server.publish(doc)
+		case "textDocument/didChange":
+			if len(params.ContentChanges) > 0 {
+				doc = NewLspDocument(doc.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+				server.docs[doc.URI] = doc
+				server.publish(doc)
+			}
+		case "textDocument/didClose":
+			delete(server.docs, doc.URI)
+			server.notify("textDocument/publishDiagnostics", map[string]interface{}{"uri": doc.URI, "diagnostics": []interface{}{}})
+		case "textDocument/definition":
+			server.reply(request.ID, server.definition(doc, params.Position))
+		case "textDocument/references":
+			server.reply(request.ID, server.references(doc, params.Position, params.Context.IncludeDeclaration))
+		case "textDocument/hover":
+			server.reply(request.ID, server.hover(doc, params.Position))
+		case "textDocument/completion":
+			server.reply(request.ID, server.completion(doc, params.Position))
+		case "textDocument/documentSymbol":
+			server.reply(request.ID, server.symbols(doc))
+		case "textDocument/formatting":
+			server.reply(request.ID, server.formatting(doc))
+		default:
+			if request.ID != nil {
+				server.fail(request.ID, -32601, "method not found: " + request.Method)
+			}
+	}
+}
+
+func (server *LspServer) definition(doc *LspDocument, pos LspPosition) interface{} {
+	ref, ok := doc.RefAt(pos)
+	if !ok {
+		return nil
+	}
+	if ref.Block {
+		block, ok := doc.FindBlock(ref)
+		if !ok || block.URI == "" {
+			return nil
+		}
+		return LspLocation{URI: block.URI, Range: block.Doc.TokenRange(block.Token)}
+	}
+	for _, other := range SourceRefs(LexAll(doc.Text)) {
+		if !other.Block && other.Def && other.Name == ref.Name {
+			return LspLocation{URI: doc.URI, Range: doc.TokenRange(other.Token)}
+		}
+	}
+	return nil
+}
+
+func (server *LspServer) references(doc *LspDocument, pos LspPosition, declaration bool) []LspLocation {
+	locations := []LspLocation{}
+	ref, ok := doc.RefAt(pos)
+	if !ok {
+		return locations
+	}
+	for _, other := range SourceRefs(LexAll(doc.Text)) {
+		if other.Name == ref.Name && other.Block == ref.Block && other.Module == ref.Module && (declaration || !other.Def) {
+			locations = append(locations, LspLocation{URI: doc.URI, Range: doc.TokenRange(other.Token)})
+		}
+	}
+	return locations
+}
+
+func (server *LspServer) hover(doc *LspDocument, pos LspPosition) interface{} {
+	ref, ok := doc.RefAt(pos)
+	if !ok {
+		token, ok := doc.TokenAt(pos)
+		if !ok || !isWord(token.Value) {
+			return nil
+		}
+		return map[string]interface{}{
+			"contents": map[string]interface{}{"kind": "markdown", "value": "`" + token.Value + "` (builtin word)"},
+			"range": doc.TokenRange(token),
+		}
+	}
+	value := "variable `" + ref.Name + "`"
+	if ref.Block {
+		block, ok := doc.FindBlock(ref)
+		if !ok {
+			return nil
+		}
+		value = "```\nblock " + ref.Name
+		if block.Info.Effect != "" {
+			value += " " + block.Info.Effect
+		}
+		value += "\n```"
+		if block.Info.Doc != "" {
+			value += "\n" + block.Info.Doc
+		}
+	}
+	return map[string]interface{}{
+		"contents": map[string]interface{}{"kind": "markdown", "value": value},
+		"range": doc.TokenRange(ref.Token),
+	}
+}
+
+// LSP kinds of completion items and symbols.
+const (
+	lspCompletionFunction = 3
+	lspCompletionVariable = 6
+	lspCompletionKeyword = 14
+	lspSymbolFunction = 12
+	lspSymbolVariable = 13
+)
+
+// qualifiedCall matches a line that ends in 'call m.' and maybe the
+// start of a block name.
+var qualifiedCall = regexp.MustCompile(`call\s+([\pL_][\pL\pN_?-]*)\.[\pL\pN_?-]*$`)
+
+func (server *LspServer) completion(doc *LspDocument, pos LspPosition) []map[string]interface{} {
+	items := []map[string]interface{}{}
+	seen := map[string]bool{}
+	add := func(label string, kind int, detail string) {
+		if !seen[label] {
+			seen[label] = true
+			items = append(items, map[string]interface{}{"label": label, "kind": kind, "detail": detail})
+		}
+	}
+	// after 'call m.' only the blocks m exports make sense
+	line, column := doc.FromLsp(pos)
+	if line >= 1 && line-1 < len(doc.lines) {
+		before := []rune(doc.lines[line-1])
+		if column-1 <= len(before) {
+			before = before[:column-1]
+		}
+		if match := qualifiedCall.FindStringSubmatch(string(before)); match != nil {
+			for _, imp := range doc.imports() {
+				if imp[1] != match[1] {
+					continue
+				}
+				if _, src, ok := doc.importSource(imp[0]); ok {
+					_, docs := ParseDocs(src)
+					for _, info := range docs {
+						if info.Exported {
+							add(info.Name, lspCompletionFunction, info.Effect)
+						}
+					}
+				}
+			}
+			return items
+		}
+	}
+	for _, ref := range SourceRefs(LexAll(doc.Text)) {
+		if ref.Block && ref.Def {
+			add(ref.Name, lspCompletionFunction, "block")
+		} else if !ref.Block && ref.Def {
+			add(ref.Name, lspCompletionVariable, "variable")
+		}
+	}
+	for _, imp := range doc.imports() {
+		if imp[1] != "" {
+			continue
+		}
+		if _, src, ok := doc.importSource(imp[0]); ok {
+			for _, ref := range SourceRefs(LexAll(src)) {
+				if ref.Block && ref.Def {
+					add(ref.Name, lspCompletionFunction, "block from " + imp[0])
+				}
+			}
+		}
+	}
+	words := append([]string{}, Keywords...)
+	for name := range Builtins {
+		if !strings.Contains(name, ".") {
+			words = append(words, name)
+		}
+	}
+	sort.Strings(words)
+	for _, word := range words {
+		add(word, lspCompletionKeyword, "builtin")
+	}
+	return items
+}
+
+func (server *LspServer) symbols(doc *LspDocument) []map[string]interface{} {
+	symbols := []map[string]interface{}{}
+	seen := map[string]bool{}
+	for _, ref := range SourceRefs(LexAll(doc.Text)) {
+		if !ref.Def || !ref.Block && seen[ref.Name] {
+			continue
+		}
+		kind := lspSymbolVariable
+		if ref.Block {
+			kind = lspSymbolFunction
+		} else {
+			seen[ref.Name] = true
+		}
+		symbols = append(symbols, map[string]interface{}{
+			"name": ref.Name,
+			"kind": kind,
+			"range": doc.TokenRange(ref.Token),
+			"selectionRange": doc.TokenRange(ref.Token),
+		})
+	}
+	return symbols
+}
+
+func (server *LspServer) formatting(doc *LspDocument) []map[string]interface{} {
+	if CheckSyntax(doc.Text) != nil {
+		return nil
+	}
+	formatted := FormatSource(doc.Text)
+	if formatted == doc.Text {
+		return []map[string]interface{}{}
+	}
+	last := len(doc.lines)
+	end := doc.ToLsp(last, utf8.RuneCountInString(doc.lines[last-1]) + 1)
+	return []map[string]interface{}{{
+		"range": LspRange{End: end},
+		"newText": formatted,
+	}}
+}
+
+// LspCommand implements 'tsh lsp'.
+func LspCommand(args []string) int {
+	if len(args) > 0 && args[0] != "--stdio" {
+		fmt.Fprintln(os.Stderr, "Usage: tsh lsp [--stdio]")
+		return ExitUsage
+	}
+	server := &LspServer{in: bufio.NewReader(os.Stdin), out: Out, docs: map[string]*LspDocument{}}
+	return server.Serve()
+}
+
+
+// -----------------------------
+// ---------- Debugger ---------
+// -----------------------------
+
+// Debug is the debugger the script runs under, nil when it runs
+// normally.
+var Debug *Debugger
+
+// StepMode is how far a script runs after the debugger resumes it.
+type StepMode int
+const (
+	StepContinue StepMode = iota
+	// StepInto stops at the next line, entering calls.
+	StepInto
+	// StepOver stops at the next line of the same or an outer frame.
+	StepOver
+	// StepOut stops at the next line of an outer frame.
+	StepOut
+	// StepPause stops at the next expression.
+	StepPause
+)
+
+// Breakpoint stops the script at a line of File, or on entering the
+// block Block. File is absolute, or a std module path.
+type Breakpoint struct {
+	File string
+	Line int
+	Block string
+}
+
+func (breakpoint Breakpoint) String() string {
+	if breakpoint.Block != "" {
+		return "block " + breakpoint.Block
+	}
+	return fmt.Sprintf("%s:%d", DisplayPath(breakpoint.File), breakpoint.Line)
+}
+
+// Frame is a block call, an import, or the main script.
+type Frame struct {
+	Name string
+	Pos Position
+	// Module holds the variables the frame sees.
+	Module *Module
+	// entered is set until the frame visits its first expression.
+	entered bool
+}
+
+// Debugger watches every expression the interpreter visits and calls
+// Stop when the script should pause. Stop returns when it resumes.
+type Debugger struct {
+	Script string
+	Breakpoints []Breakpoint
+	Watches []string
+	Frames []Frame
+	Stop func(reason string)
+	mode StepMode
+	depth int
+	// pauseReason is what StepPause reports.
+	pauseReason string
+	// Exit, when set, is called instead of ending the process by a
+	// front end that outlives the script. It must not return.
+	Exit func(code int)
+	// evaluating is set while Evaluate runs, which never stops.
+	evaluating bool
+	// mutex guards the breakpoints and the step mode, which a front
+	// end may change while the script runs.
+	mutex sync.Mutex
+	files map[string]string
+}
+
+func NewDebugger(script string) *Debugger {
+	return &Debugger{
+		Script: script,
+		Frames: []Frame{{Name: "main", Module: CurrentModule, entered: true}},
+		files: map[string]string{},
+	}
+}
+
+// AbsFile is path as breakpoints store it.
+func (debugger *Debugger) AbsFile(path string) string {
+	if path == "" {
+		path = debugger.Script
+	}
+	if abs, ok := debugger.files[path]; ok {
+		return abs
+	}
+	abs := path
+	if _, std := StdModule(path); !std {
+		if full, err := filepath.Abs(path); err == nil {
+			abs = full
+		}
+	}
+	debugger.files[path] = abs
+	return abs
+}
+
+// ParseBreakpoint reads 'LINE', 'FILE:LINE' or a block name.
+func (debugger *Debugger) ParseBreakpoint(spec string) Breakpoint {
+	file, line := "", spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		file, line = spec[:i], spec[i+1:]
+	}
+	if n, err := strconv.Atoi(line); err == nil && n > 0 {
+		return Breakpoint{File: debugger.AbsFile(file), Line: n}
+	}
+	return Breakpoint{Block: spec}
+}
+
+// PauseNext stops the script at the next expression it runs.
+func (debugger *Debugger) PauseNext(reason string) {
+	debugger.mutex.Lock()
+	defer debugger.mutex.Unlock()
+	debugger.mode = StepPause
+	debugger.pauseReason = reason
+}
+
+// SetBreakpoints replaces the breakpoints on the lines of file.
+func (debugger *Debugger) SetBreakpoints(path string, lines []int) {
+	debugger.mutex.Lock()
+	defer debugger.mutex.Unlock()
+	file := debugger.AbsFile(path)
+	kept := []Breakpoint{}
+	for _, breakpoint := range debugger.Breakpoints {
+		if breakpoint.Block != "" || breakpoint.File != file {
+			kept = append(kept, breakpoint)
+		}
+	}
+	for _, line := range lines {
+		kept = append(kept, Breakpoint{File: file, Line: line})
+	}
+	debugger.Breakpoints = kept
+}
+
+// SetBlockBreakpoints replaces the breakpoints on blocks.
+func (debugger *Debugger) SetBlockBreakpoints(names []string) {
+	debugger.mutex.Lock()
+	defer debugger.mutex.Unlock()
+	kept := []Breakpoint{}
+	for _, breakpoint := range debugger.Breakpoints {
+		if breakpoint.Block == "" {
+			kept = append(kept, breakpoint)
+		}
+	}
+	for _, name := range names {
+		kept = append(kept, Breakpoint{Block: name})
+	}
+	debugger.Breakpoints = kept
+}
+
+// Resume lets the script run until mode says it should stop again.
+func (debugger *Debugger) Resume(mode StepMode) {
+	debugger.mutex.Lock()
+	defer debugger.mutex.Unlock()
+	debugger.mode = mode
+	debugger.depth = len(debugger.Frames)
+}
+
+func (debugger *Debugger) Top() *Frame {
+	return &debugger.Frames[len(debugger.Frames)-1]
+}
+
+func (debugger *Debugger) Enter(name string) {
+	if debugger.evaluating {
+		return
+	}
+	debugger.mutex.Lock()
+	defer debugger.mutex.Unlock()
+	debugger.Frames = append(debugger.Frames, Frame{Name: name, Pos: CurrentPos, Module: CurrentModule, entered: true})
+	for _, breakpoint := range debugger.Breakpoints {
+		if breakpoint.Block == name {
+			debugger.mode, debugger.pauseReason = StepPause, "breakpoint"
+		}
+	}
+}
+
+func (debugger *Debugger) Leave() {
+	if debugger.evaluating {
+		return
+	}
+	debugger.mutex.Lock()
+	defer debugger.mutex.Unlock()
+	debugger.Frames = debugger.Frames[:len(debugger.Frames)-1]
+}
+
+// Visit is called before each expression is run.
+func (debugger *Debugger) Visit(expr Expr) {
+	if debugger.evaluating {
+		return
+	}
+	if reason := debugger.stopReason(expr); reason != "" {
+		debugger.Pause(reason)
+	}
+}
+
+// stopReason tells why the script should stop before expr, if it should.
+func (debugger *Debugger) stopReason(expr Expr) string {
+	debugger.mutex.Lock()
+	defer debugger.mutex.Unlock()
+	frame := debugger.Top()
+	newLine := frame.entered || frame.Pos.line != expr.Pos.line || frame.Pos.file != expr.Pos.file
+	frame.Pos, frame.Module, frame.entered = expr.Pos, CurrentModule, false
+	depth := len(debugger.Frames)
+	switch {
+		case debugger.mode == StepPause:
+			return debugger.pauseReason
+		case !newLine:
+			return ""
+		case debugger.mode == StepInto,
+			debugger.mode == StepOver && depth <= debugger.depth,
+			debugger.mode == StepOut && depth < debugger.depth:
+			return "step"
+		case debugger.AtBreakpoint(expr.Pos):
+			return "breakpoint"
+	}
+	return ""
+}
+
+func (debugger *Debugger) AtBreakpoint(pos Position) bool {
+	for _, breakpoint := range debugger.Breakpoints {
+		if breakpoint.Block == "" && breakpoint.Line == pos.line && breakpoint.File == debugger.AbsFile(pos.file) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pause stops the script where it is and hands control to Stop.
+func (debugger *Debugger) Pause(reason string) {
+	debugger.Resume(StepContinue)
+	pos := CurrentPos
+	Out.Flush()
+	debugger.Stop(reason)
+	CurrentPos = pos
+}
+
+// Evaluate runs src on copies of the data stack and the variables and
+// shows the value it leaves on top, so looking at the script never
+// changes it. It cannot exit or read input.
+func (debugger *Debugger) Evaluate(src string) (result string, err error) {
+	saved, pos := Stack, CurrentPos
+	Stack = append([]Expr{}, saved...)
+	modules := []*Module{CurrentModule}
+	for _, module := range Modules {
+		modules = append(modules, module)
+	}
+	variables := map[*Module]map[string]Expr{}
+	for _, module := range modules {
+		variables[module] = module.Variables
+		module.Variables = map[string]Expr{}
+		for name, value := range variables[module] {
+			module.Variables[name] = value
+		}
+	}
+	VariableScope = CurrentModule.Variables
+	debugger.evaluating = true
+	defer func() {
+		debugger.evaluating = false
+		for module, saved := range variables {
+			module.Variables = saved
+		}
+		VariableScope = CurrentModule.Variables
+		Stack, CurrentPos = saved, pos
+		if r := recover(); r != nil {
+			exception, ok := r.(*Exception)
+			if !ok {
+				panic(r)
+			}
+			err = errors.New(exception.Kind + ": " + exception.Message)
+		}
+	}()
+	parser := ParserInit(LexerInit(strings.NewReader(src)))
+	exprs, _ := ParserParse(parser)
+	VisitExpr(exprs)
+	if len(Stack) == 0 {
+		return "", errors.New("nothing on the stack")
+	}
+	return DebugValue(Stack[len(Stack)-1]), nil
+}
+
+// NotInEvaluation raises for a word that would end the script or read
+// its input from inside Evaluate.
+func NotInEvaluation(word string) {
+	if Debug != nil && Debug.evaluating {
+		Raise("DebugError", fmt.Sprintf("'%s' cannot run in an evaluation", word))
+	}
+}
+
+// DebugValue shows a value with strings quoted, so "1" and 1 differ.
+func DebugValue(expr Expr) string {
+	if expr.Type == ExprStr {
+		return fmt.Sprintf("'%s'", expr.AsStr)
+	}
+	return ExprString(expr)
+}
+
+// SourceLine is a line of a script, for showing where it stopped.
+func SourceLine(path string, line int) string {
+	file, err := OpenImport(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		if n == line {
+			return scanner.Text()
+		}
+	}
+	return ""
+}
+
+func init() {
+	// 'breakpoint' stops the debugger where it is written and does
+	// nothing when the script is not being debugged.
+	Builtins["breakpoint"] = func() {
+		if Debug != nil {
+			Debug.Pause("breakpoint")
+		}
+	}
+}
+
+// DebugTerminal is the front end of 'tsh debug': it reads commands from
+// standard input at every stop.
+type DebugTerminal struct {
+	*Debugger
+	echo bool
+}
+
+func (terminal *DebugTerminal) Where(reason string) {
+	frame := terminal.Top()
+	path := terminal.AbsFile(frame.Pos.file)
+	fmt.Fprintf(Out, "stopped (%s) at %s:%d:%d in %s\n", reason, DisplayPath(path), frame.Pos.line, frame.Pos.column, frame.Name)
+	fmt.Fprintf(Out, "%5d | %s\n", frame.Pos.line, SourceLine(path, frame.Pos.line))
+	terminal.PrintStack()
+	terminal.PrintVars()
+	for _, watch := range terminal.Watches {
+		terminal.PrintEval("watch " + watch, watch)
+	}
+}
+
+func (terminal *DebugTerminal) PrintStack() {
+	fmt.Fprintf(Out, "stack <%d>", len(Stack))
+	for _, expr := range Stack {
+		fmt.Fprint(Out, " " + DebugValue(expr))
+	}
+	fmt.Fprintln(Out, " ← top")
+}
+
+func (terminal *DebugTerminal) PrintVars() {
+	names := []string{}
+	for name := range VariableScope {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(Out, "  %s = %s\n", name, DebugValue(VariableScope[name]))
+	}
+}
+
+func (terminal *DebugTerminal) PrintEval(label string, src string) {
+	if value, err := terminal.Evaluate(src); err != nil {
+		fmt.Fprintf(Out, "%s: %s\n", label, err)
+	} else {
+		fmt.Fprintf(Out, "%s = %s\n", label, value)
+	}
+}
+
+func (terminal *DebugTerminal) PrintHelp() {
+	fmt.Fprintln(Out, "Commands:")
+	fmt.Fprintln(Out, "  c, continue          run to the next breakpoint")
+	fmt.Fprintln(Out, "  s, step              run to the next line, into calls")
+	fmt.Fprintln(Out, "  n, next              run to the next line, over calls")
+	fmt.Fprintln(Out, "  o, out               run until the current block returns")
+	fmt.Fprintln(Out, "  b, break [LINE|FILE:LINE|BLOCK]")
+	fmt.Fprintln(Out, "                       set a breakpoint, or list them")
+	fmt.Fprintln(Out, "  d, delete [N]        delete breakpoint N, or all of them")
+	fmt.Fprintln(Out, "  w, watch [EXPR]      show EXPR at every stop, or list the watches")
+	fmt.Fprintln(Out, "  unwatch [N]          delete watch N, or all of them")
+	fmt.Fprintln(Out, "  p, print EXPR        evaluate EXPR on copies of the stack and variables")
+	fmt.Fprintln(Out, "  bt, frames           show the call frames")
+	fmt.Fprintln(Out, "  stack                show the data stack")
+	fmt.Fprintln(Out, "  vars                 show the variables")
+	fmt.Fprintln(Out, "  l, where             show where the script stopped again")
+	fmt.Fprintln(Out, "  q, quit              end the script")
+}
+
+// Stop reads commands until one resumes the script.
+func (terminal *DebugTerminal) Stop(reason string) {
+	terminal.Where(reason)
+	for {
+		fmt.Fprint(Out, "(tsh) ")
+		Out.Flush()
+		line, ok := ReadLine()
+		if !ok {
+			fmt.Fprintln(Out)
+			Exit(ExitOK)
+		}
+		if terminal.echo {
+			fmt.Fprintln(Out, line)
+		}
+		command, arg := strings.TrimSpace(line), ""
+		if i := strings.IndexFunc(command, unicode.IsSpace); i >= 0 {
+			command, arg = command[:i], strings.TrimSpace(command[i:])
+		}
+		switch command {
+			case "":
+			case "c", "continue":
+				terminal.Resume(StepContinue)
+				return
+			case "s", "step":
+				terminal.Resume(StepInto)
+				return
+			case "n", "next":
+				terminal.Resume(StepOver)
+				return
+			case "o", "out":
+				terminal.Resume(StepOut)
+				return
+			case "b", "break":
+				if arg != "" {
+					terminal.Breakpoints = append(terminal.Breakpoints, terminal.ParseBreakpoint(arg))
+				}
+				for i, breakpoint := range terminal.Breakpoints {
+					fmt.Fprintf(Out, "%d: %s\n", i+1, breakpoint)
+				}
+			case "d", "delete":
+				n, err := strconv.Atoi(arg)
+				if arg == "" {
+					terminal.Breakpoints = nil
+				} else if err != nil || n < 1 || n > len(terminal.Breakpoints) {
+					fmt.Fprintf(Out, "no breakpoint '%s'\n", arg)
+				} else {
+					terminal.Breakpoints = append(terminal.Breakpoints[:n-1], terminal.Breakpoints[n:]...)
+				}
+			case "w", "watch":
+				if arg != "" {
+					terminal.Watches = append(terminal.Watches, arg)
+				}
+				for i, watch := range terminal.Watches {
+					fmt.Fprintf(Out, "%d: %s\n", i+1, watch)
+				}
+			case "unwatch":
+				n, err := strconv.Atoi(arg)
+				if arg == "" {
+					terminal.Watches = nil
+				} else if err != nil || n < 1 || n > len(terminal.Watches) {
+					fmt.Fprintf(Out, "no watch '%s'\n", arg)
+				} else {
+					terminal.Watches = append(terminal.Watches[:n-1], terminal.Watches[n:]...)
+				}
+			case "p", "print":
+				terminal.PrintEval(arg, arg)
+			case "stack":
+				terminal.PrintStack()
+			case "vars":
+				terminal.PrintVars()
+			case "bt", "frames":
+				for i := len(terminal.Frames) - 1; i >= 0; i-- {
+					frame := terminal.Frames[i]
+					fmt.Fprintf(Out, "#%d %s at %s:%d:%d\n", len(terminal.Frames)-1-i, frame.Name, DisplayPath(terminal.AbsFile(frame.Pos.file)), frame.Pos.line, frame.Pos.column)
+				}
+			case "l", "where":
+				terminal.Where(reason)
+			case "q", "quit":
+				Exit(ExitOK)
+			case "h", "help":
+				terminal.PrintHelp()
+			default:
+				fmt.Fprintf(Out, "unknown command '%s', try 'help'\n", command)
+		}
+	}
+}
+
+// DebugCommand implements 'tsh debug'.
+func DebugCommand(args []string) int {
+	breaks, watches := []string{}, []string{}
+	flags:
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+			case "-b", "--break", "-w", "--watch":
+				if len(args) < 2 {
+					fmt.Fprintln(os.Stderr, "Error: '" + args[0] + "' expects an argument")
+					return ExitUsage
+				}
+				if args[0] == "-b" || args[0] == "--break" {
+					breaks = append(breaks, args[1])
+				} else {
+					watches = append(watches, args[1])
+				}
+				args = args[1:]
+			case "--sandbox":
+				Sandbox = true
+			case "--":
+				args = args[1:]
+				break flags
+			default:
+				fmt.Fprintln(os.Stderr, "Error: unknown flag '" + args[0] + "'")
+				return ExitUsage
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: tsh debug [-b LINE|FILE:LINE|BLOCK]... [-w EXPR]... <filename>.t# [--] [arguments]")
+		return ExitUsage
+	}
+	path := args[0]
+	Args = args[1:]
+	if len(Args) > 0 && Args[0] == "--" {
+		Args = Args[1:]
+	}
+	terminal := &DebugTerminal{Debugger: NewDebugger(path), echo: !isTerminal(os.Stdin)}
+	for _, spec := range breaks {
+		terminal.Breakpoints = append(terminal.Breakpoints, terminal.ParseBreakpoint(spec))
+	}
+	terminal.Watches = watches
+	terminal.Debugger.Stop = terminal.Stop
+	// without breakpoints there is nowhere to stop, so start paused
+	if len(terminal.Breakpoints) == 0 {
+		terminal.PauseNext("entry")
+	}
+	Debug = terminal.Debugger
+	RunScript(path)
+	return ExitOK
+}
+
+
+// -----------------------------
+// ------------ DAP ------------
+// -----------------------------
+
+// DapServer runs a script under the debugger for an editor speaking
+// the Debug Adapter Protocol over standard input and output. The
+// script runs on its own goroutine; requests are read on the main one.
+type DapServer struct {
+	in *bufio.Reader
+	out *bufio.Writer
+	// mutex keeps messages from both goroutines whole and in order.
+	mutex sync.Mutex
+	seq int
+	debugger *Debugger
+	program string
+	launched, configured, started, paused bool
+	stopOnEntry bool
+	// stops gets a value each time the script stops, and resume
+	// lets it go on, or with false ends it.
+	stops chan bool
+	resume chan bool
+	exited chan bool
+	// handles are the lists the editor can expand during a stop.
+	handles [][]DapVariable
+}
+
+// DapVariable is a named value in the variables view.
+type DapVariable struct {
+	Name string
+	Value Expr
+}
+
+type dapRequest struct {
+	Seq int `json:"seq"`
+	Command string `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapArguments struct {
+	Program string `json:"program"`
+	Args []string `json:"args"`
+	Cwd string `json:"cwd"`
+	StopOnEntry bool `json:"stopOnEntry"`
+	Source struct {
+		Path string `json:"path"`
+	} `json:"source"`
+	Breakpoints []struct {
+		Line int `json:"line"`
+		Name string `json:"name"`
+	} `json:"breakpoints"`
+	FrameID int `json:"frameId"`
+	VariablesReference int `json:"variablesReference"`
+	Expression string `json:"expression"`
+	TerminateDebuggee *bool `json:"terminateDebuggee"`
+}
+
+// dapExit unwinds the script's goroutine when it calls 'exit'.
+type dapExit int
+
+// dapOutput turns what the script prints into output events.
+type dapOutput struct {
+	server *DapServer
+	category string
+}
+
+func (output dapOutput) Write(data []byte) (int, error) {
+	output.server.event("output", map[string]interface{}{"category": output.category, "output": string(data)})
+	return len(data), nil
+}
+
+func (server *DapServer) send(message map[string]interface{}) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.seq++
+	message["seq"] = server.seq
+	WriteMessage(server.out, message)
+}
+
+func (server *DapServer) event(name string, body interface{}) {
+	message := map[string]interface{}{"type": "event", "event": name}
+	if body != nil {
+		message["body"] = body
+	}
+	server.send(message)
+}
+
+func (server *DapServer) reply(request dapRequest, body interface{}) {
+	message := map[string]interface{}{
+		"type": "response",
+		"request_seq": request.Seq,
+		"command": request.Command,
+		"success": true,
+	}
+	if body != nil {
+		message["body"] = body
+	}
+	server.send(message)
+}
+
+func (server *DapServer) fail(request dapRequest, err string) {
+	server.send(map[string]interface{}{
+		"type": "response",
+		"request_seq": request.Seq,
+		"command": request.Command,
+		"success": false,
+		"message": err,
+	})
+}
+
+// running reports whether the script has started and not yet ended.
+func (server *DapServer) running() bool {
+	if !server.started {
+		return false
+	}
+	select {
+		case <-server.exited:
+			return false
+		default:
+			return true
+	}
+}
+
+// poll notices a stop that no request has waited for yet.
+func (server *DapServer) poll() {
+	select {
+		case <-server.stops:
+			server.paused = true
+		default:
+	}
+}
+
+// waitStop waits until the script stops or ends, and reports whether
+// it is stopped. Requests that only make sense during a stop wait
+// here, so a client may send them right after resuming.
+func (server *DapServer) waitStop() bool {
+	if server.paused {
+		return true
+	}
+	if !server.running() {
+		return false
+	}
+	select {
+		case <-server.stops:
+			server.paused = true
+		case <-server.exited:
+	}
+	return server.paused
+}
+
+// Stop runs on the script's goroutine at every stop.
+func (server *DapServer) Stop(reason string) {
+	if reason == "terminate" {
+		Exit(ExitOK)
+	}
+	server.event("stopped", map[string]interface{}{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+	server.stops <- true
+	if !<-server.resume {
+		Exit(ExitOK)
+	}
+}
+
+// continueWith resumes a stopped script.
+func (server *DapServer) continueWith(mode StepMode) {
+	server.debugger.Resume(mode)
+	server.paused = false
+	server.handles = nil
+	server.resume <- true
+}
+
+// terminate ends the script, wherever it is, and waits for it.
+func (server *DapServer) terminate() {
+	server.finish(false)
+}
+
+// detach lets the script run to its end, and waits for it.
+func (server *DapServer) detach() {
+	server.debugger.mutex.Lock()
+	server.debugger.Breakpoints = nil
+	server.debugger.mutex.Unlock()
+	server.finish(true)
+}
+
+// finish resumes the script at every stop, or with keep false ends it,
+// until it has ended.
+func (server *DapServer) finish(keep bool) {
+	if !server.started {
+		return
+	}
+	if !keep {
+		server.debugger.PauseNext("terminate")
+	}
+	if server.paused {
+		server.paused = false
+		server.resume <- keep
+	}
+	for {
+		select {
+			case <-server.stops:
+				server.resume <- keep
+			case <-server.exited:
+				return
+		}
+	}
+}
+
+// run is the script's goroutine.
+func (server *DapServer) run(file io.Reader) {
+	code := ExitOK
+	defer func() {
+		if r := recover(); r != nil {
+			switch r := r.(type) {
+				case dapExit:
+					code = int(r)
+				case *Exception:
+					Out.Flush()
+					dapOutput{server, "stderr"}.Write([]byte(r.Error() + "\n"))
+					code = ExitRuntimeError
+					if r.Kind == "SyntaxError" {
+						code = ExitSyntaxError
+					}
+				default:
+					panic(r)
+			}
+		}
+		Out.Flush()
+		server.event("exited", map[string]interface{}{"exitCode": code})
+		server.event("terminated", nil)
+		close(server.exited)
+	}()
+	if server.stopOnEntry {
+		server.debugger.PauseNext("entry")
+	}
+	Debug = server.debugger
+	VisitExpr(ParseScript(server.program, file))
+}
+
+func (server *DapServer) start() {
+	file, err := os.Open(server.program)
+	if err != nil {
+		dapOutput{server, "stderr"}.Write([]byte("Error: file '" + server.program + "' does not exist\n"))
+		server.event("terminated", nil)
+		close(server.exited)
+		return
+	}
+	server.started = true
+	go server.run(file)
+}
+
+func (server *DapServer) source(path string) map[string]interface{} {
+	abs := server.debugger.AbsFile(path)
+	source := map[string]interface{}{"name": filepath.Base(abs)}
+	if _, std := StdModule(abs); std {
+		source["name"] = abs
+	} else {
+		source["path"] = abs
+	}
+	return source
+}
+
+func (server *DapServer) handle(variables []DapVariable) int {
+	server.handles = append(server.handles, variables)
+	return len(server.handles)
+}
+
+// frame is the frame with the id stackTrace gave it.
+func (server *DapServer) frame(id int) (Frame, bool) {
+	if id < 1 || id > len(server.debugger.Frames) {
+		return Frame{}, false
+	}
+	return server.debugger.Frames[id-1], true
+}
+
+// Serve handles requests until 'disconnect' and returns the exit status.
+func (server *DapServer) Serve() int {
+	for {
+		body, err := ReadMessage(server.in)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(os.Stderr, "tsh dap: " + err.Error())
+			}
+			server.poll()
+			server.terminate()
+			return ExitRuntimeError
+		}
+		var request dapRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			fmt.Fprintln(os.Stderr, "tsh dap: " + err.Error())
+			continue
+		}
+		var args dapArguments
+		json.Unmarshal(request.Arguments, &args)
+		if request.Command == "disconnect" {
+			server.poll()
+			if args.TerminateDebuggee != nil && !*args.TerminateDebuggee {
+				server.detach()
+			} else {
+				server.terminate()
+			}
+			server.reply(request, nil)
+			return ExitOK
+		}
+		server.handleRequest(request, args)
+	}
+}
+
+func (server *DapServer) handleRequest(request dapRequest, args dapArguments) {
+	server.poll()
+	switch request.Command {
+		case "initialize":
+			server.reply(request, map[string]interface{}{
+				"supportsConfigurationDoneRequest": true,
+				"supportsFunctionBreakpoints": true,
+				"supportsEvaluateForHovers": true,
+				"supportsTerminateRequest": true,
+			})
+			server.event("initialized", nil)
+		case "launch":
+			if args.Program == "" {
+				server.fail(request, "launch needs a 'program'")
+				return
+			}
+			if args.Cwd != "" {
+				if err := os.Chdir(args.Cwd); err != nil {
+					server.fail(request, err.Error())
+					return
+				}
+			}
+			if _, err := os.Stat(args.Program); err != nil {
+				server.fail(request, "file '" + args.Program + "' does not exist")
+				return
+			}
+			server.program, server.stopOnEntry, server.launched = args.Program, args.StopOnEntry, true
+			server.debugger.Script = args.Program
+			Args = args.Args
+			server.reply(request, nil)
+			if server.configured {
+				server.start()
+			}
+		case "configurationDone":
+			server.configured = true
+			server.reply(request, nil)
+			if server.launched {
+				server.start()
+			}
+		case "setBreakpoints":
+			lines := []int{}
+			for _, breakpoint := range args.Breakpoints {
+				lines = append(lines, breakpoint.Line)
+			}
+			server.debugger.SetBreakpoints(args.Source.Path, lines)
+			verified := []map[string]interface{}{}
+			for _, line := range lines {
+				verified = append(verified, map[string]interface{}{"verified": true, "line": line})
+			}
+			server.reply(request, map[string]interface{}{"breakpoints": verified})
+		case "setFunctionBreakpoints":
+			names := []string{}
+			verified := []map[string]interface{}{}
+			for _, breakpoint := range args.Breakpoints {
+				names = append(names, breakpoint.Name)
+				verified = append(verified, map[string]interface{}{"verified": true})
+			}
+			server.debugger.SetBlockBreakpoints(names)
+			server.reply(request, map[string]interface{}{"breakpoints": verified})
+		case "setExceptionBreakpoints":
+			server.reply(request, map[string]interface{}{"breakpoints": []interface{}{}})
+		case "threads":
+			server.reply(request, map[string]interface{}{
+				"threads": []map[string]interface{}{{"id": 1, "name": "main"}},
+			})
+		case "pause":
+			if server.running() && !server.paused {
+				server.debugger.PauseNext("pause")
+			}
+			server.reply(request, nil)
+		case "terminate":
+			server.terminate()
+			server.reply(request, nil)
+		case "continue", "next", "stepIn", "stepOut":
+			if !server.waitStop() {
+				server.fail(request, "the program is not stopped")
+				return
+			}
+			mode := map[string]StepMode{"continue": StepContinue, "next": StepOver, "stepIn": StepInto, "stepOut": StepOut}[request.Command]
+			if request.Command == "continue" {
+				server.reply(request, map[string]interface{}{"allThreadsContinued": true})
+			} else {
+				server.reply(request, nil)
+			}
+			server.continueWith(mode)
+		case "stackTrace":
+			if !server.waitStop() {
+				server.fail(request, "the program is not stopped")
+				return
+			}
+			frames := []map[string]interface{}{}
+			for i := len(server.debugger.Frames); i >= 1; i-- {
+				frame, _ := server.frame(i)
+				frames = append(frames, map[string]interface{}{
+					"id": i,
+					"name": frame.Name,
+					"source": server.source(frame.Pos.file),
+					"line": frame.Pos.line,
+					"column": frame.Pos.column,
+				})
+			}
+			server.reply(request, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)})
+		case "scopes":
+			if !server.waitStop() {
+				server.fail(request, "the program is not stopped")
+				return
+			}
+			frame, ok := server.frame(args.FrameID)
+			if !ok {
+				server.fail(request, "no such frame")
+				return
+			}
+			variables := []DapVariable{}
+			names := []string{}
+			for name := range frame.Module.Variables {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				variables = append(variables, DapVariable{Name: name, Value: frame.Module.Variables[name]})
+			}
+			stack := []DapVariable{}
+			for i := len(Stack) - 1; i >= 0; i-- {
+				stack = append(stack, DapVariable{Name: strconv.Itoa(len(Stack) - 1 - i), Value: Stack[i]})
+			}
+			server.reply(request, map[string]interface{}{"scopes": []map[string]interface{}{
+				{"name": "Variables", "variablesReference": server.handle(variables), "namedVariables": len(variables), "expensive": false},
+				{"name": "Stack", "variablesReference": server.handle(stack), "indexedVariables": len(stack), "expensive": false},
+			}})
+		case "variables":
+			if !server.waitStop() || args.VariablesReference < 1 || args.VariablesReference > len(server.handles) {
+				server.fail(request, "no such variables")
+				return
+			}
+			variables := []map[string]interface{}{}
+			for _, variable := range server.handles[args.VariablesReference-1] {
+				reference := 0
+				if variable.Value.Type == ExprArr {
+					items := []DapVariable{}
+					for i, item := range variable.Value.AsArr {
+						items = append(items, DapVariable{Name: strconv.Itoa(i), Value: item})
+					}
+					reference = server.handle(items)
+				}
+				variables = append(variables, map[string]interface{}{
+					"name": variable.Name,
+					"value": DebugValue(variable.Value),
+					"type": TypeName(variable.Value),
+					"variablesReference": reference,
+				})
+			}
+			server.reply(request, map[string]interface{}{"variables": variables})
+		case "evaluate":
+			if !server.waitStop() {
+				server.fail(request, "the program is not stopped")
+				return
+			}
+			result, err := server.debugger.Evaluate(args.Expression)
+			Out.Flush()
+			if err != nil {
+				server.fail(request, err.Error())
+				return
+			}
+			server.reply(request, map[string]interface{}{"result": result, "variablesReference": 0})
+		default:
+			server.fail(request, "unsupported request '" + request.Command + "'")
+	}
+}
+
+// DapCommand implements 'tsh dap'.
+func DapCommand(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: tsh dap")
+		return ExitUsage
+	}
+	server := &DapServer{
+		in: bufio.NewReader(os.Stdin),
+		out: bufio.NewWriter(os.Stdout),
+		debugger: NewDebugger(""),
+		stops: make(chan bool, 1),
+		resume: make(chan bool),
+		exited: make(chan bool),
+	}
+	// The protocol owns standard input and output: the script reads no
+	// input, and programs it runs write to standard error.
+	os.Stdin, os.Stdout = nil, os.Stderr
+	Stdin = bufio.NewReader(strings.NewReader(""))
+	Out, OutIsTerminal = bufio.NewWriter(dapOutput{server, "stdout"}), true
+	server.debugger.Stop = server.Stop
+	server.debugger.Exit = func(code int) { panic(dapExit(code)) }
+	defer func() {
+		Debug = nil
+	}()
+	return server.Serve()
+}
+
+
+// -----------------------------
+// ---------- Project ----------
+// -----------------------------
+
+// Manifest is a project's tsh.mod:
+//
+//	Module {
+//		name: 'app'
+//		version: '0.1.0'
+//		entry: 'main.t#'
+//		dependencies: ['../shared']
+//		packages: {
+//			greet: '../greet'
+//		}
+//	}
+type Manifest struct {
+	Path string
+	Name string
+	Description string
+	Version string
+	License string
+	RepoURL string
+	Entry string
+	Dependencies []string
+	Packages []Package
+}
+
+// Package is a library installed by 'tsh get' under tsh_modules/,
+// with the path or git URL it was fetched from.
+type Package struct {
+	Name string
+	Source string
+}
+
+const ManifestFile = "tsh.mod"
+const LockFile = "tsh.lock"
+
+// Project is the manifest of the project the script belongs to, nil
+// when there is none.
+var Project *Manifest
+
+// manifestScanner splits a tsh.mod into identifiers ('i'), strings
+// ('s') and the punctuation { } [ ] : , which stand for themselves.
+type manifestScanner struct {
+	src []rune
+	pos int
+	line int
+}
+
+func (scanner *manifestScanner) next() (rune, string, error) {
+	for scanner.pos < len(scanner.src) {
+		r := scanner.src[scanner.pos]
+		if r == '\n' {
+			scanner.line++
+		}
+		if r == '/' && scanner.pos+1 < len(scanner.src) && scanner.src[scanner.pos+1] == '/' {
+			for scanner.pos < len(scanner.src) && scanner.src[scanner.pos] != '\n' {
+				scanner.pos++
+			}
+			continue
+		}
+		if !unicode.IsSpace(r) {
+			break
+		}
+		scanner.pos++
+	}
+	if scanner.pos >= len(scanner.src) {
+		return 0, "", nil
+	}
+	r := scanner.src[scanner.pos]
+	scanner.pos++
+	switch {
+		case strings.ContainsRune("{}[]:,", r):
+			return r, string(r), nil
+		case r == '\'' || r == '"':
+			start := scanner.pos
+			for scanner.pos < len(scanner.src) && scanner.src[scanner.pos] != r {
+				if scanner.src[scanner.pos] == '\n' {
+					return 0, "", errors.New("unterminated string")
+				}
+				scanner.pos++
+			}
+			if scanner.pos >= len(scanner.src) {
+				return 0, "", errors.New("unterminated string")
+			}
+			scanner.pos++
+			return 's', string(scanner.src[start:scanner.pos-1]), nil
+		case unicode.IsLetter(r) || r == '_':
+			start := scanner.pos - 1
+			for scanner.pos < len(scanner.src) && (unicode.IsLetter(scanner.src[scanner.pos]) || unicode.IsDigit(scanner.src[scanner.pos]) || scanner.src[scanner.pos] == '_') {
+				scanner.pos++
+			}
+			return 'i', string(scanner.src[start:scanner.pos]), nil
+	}
+	return 0, "", fmt.Errorf("unexpected character '%c'", r)
+}
+
+// ParseManifest reads the tsh.mod at path. Errors carry the file and
+// line they were found at.
+func ParseManifest(path string) (*Manifest, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := &manifestScanner{src: []rune(string(src)), line: 1}
+	manifest := &Manifest{Path: path}
+	fail := func(format string, a ...interface{}) (*Manifest, error) {
+		return nil, fmt.Errorf("%s:%d: %s", path, scanner.line, fmt.Sprintf(format, a...))
+	}
+	expect := func(want rune, what string) error {
+		kind, text, err := scanner.next()
+		if err != nil {
+			return err
+		}
+		if kind != want {
+			if kind == 0 {
+				text = "end of file"
+			}
+			return fmt.Errorf("expected %s, got '%s'", what, text)
+		}
+		return nil
+	}
+	if kind, text, err := scanner.next(); err != nil {
+		return fail("%s", err)
+	} else if kind != 'i' || text != "Module" {
+		return fail("expected 'Module'")
+	}
+	if err := expect('{', "'{'"); err != nil {
+		return fail("%s", err)
+	}
+	for {
+		kind, key, err := scanner.next()
+		if err != nil {
+			return fail("%s", err)
+		}
+		if kind == '}' {
+			break
+		}
+		if kind == ',' {
+			continue
+		}
+		if kind != 'i' {
+			return fail("expected a field name, got '%s'", key)
+		}
+		if err := expect(':', "':'"); err != nil {
+			return fail("%s", err)
+		}
+		kind, value, err := scanner.next()
+		if err != nil {
+			return fail("%s", err)
+		}
+		if key == "dependencies" {
+			if kind != '[' {
+				return fail("'dependencies' expected a list of strings")
+			}
+			list := []string{}
+			for {
+				kind, value, err := scanner.next()
+				if err != nil {
+					return fail("%s", err)
+				}
+				if kind == ']' {
+					break
+				}
+				if kind == ',' {
+					continue
+				}
+				if kind != 's' {
+					return fail("'dependencies' expected a list of strings")
+				}
+				list = append(list, value)
+			}
+			manifest.Dependencies = list
+			continue
+		}
+		if key == "packages" {
+			if kind != '{' {
+				return fail("'packages' expected '{'")
+			}
+			for {
+				kind, name, err := scanner.next()
+				if err != nil {
+					return fail("%s", err)
+				}
+				if kind == '}' {
+					break
+				}
+				if kind == ',' {
+					continue
+				}
+				if kind != 'i' && kind != 's' {
+					return fail("'packages' expected a package name, got '%s'", name)
+				}
+				if err := expect(':', "':'"); err != nil {
+					return fail("%s", err)
+				}
+				kind, source, err := scanner.next()
+				if err != nil {
+					return fail("%s", err)
+				}
+				if kind != 's' {
+					return fail("package '%s' expected its source as a string", name)
+				}
+				if strings.HasPrefix(source, "-") {
+					// it would reach 'git clone' as an option
+					return fail("package '%s' has a source starting with '-'", name)
+				}
+				manifest.Packages = append(manifest.Packages, Package{Name: name, Source: source})
+			}
+			continue
+		}
+		if kind != 's' {
+			return fail("'%s' expected a string", key)
+		}
+		switch key {
+			case "name":
+				manifest.Name = value
+			case "description":
+				manifest.Description = value
+			case "version":
+				manifest.Version = value
+			case "license":
+				manifest.License = value
+			case "repo_url":
+				manifest.RepoURL = value
+			case "entry":
+				manifest.Entry = value
+			default:
+				return fail("unknown field '%s'", key)
+		}
+	}
+	if kind, text, err := scanner.next(); err != nil || kind != 0 {
+		return fail("unexpected '%s' after the closing '}'", text)
+	}
+	return manifest, nil
+}
+
+var manifestIdent = regexp.MustCompile(`^[\pL_][\pL\pN_]*$`)
+
+func quoteManifest(value string) string {
+	if strings.ContainsRune(value, '\'') {
+		return "\"" + value + "\""
+	}
+	return "'" + value + "'"
+}
+
+// String prints the manifest back in tsh.mod syntax, leaving out
+// empty fields.
+func (manifest *Manifest) String() string {
+	var b strings.Builder
+	b.WriteString("Module {\n")
+	fields := [][2]string{
+		{"name", manifest.Name},
+		{"description", manifest.Description},
+		{"version", manifest.Version},
+		{"license", manifest.License},
+		{"repo_url", manifest.RepoURL},
+		{"entry", manifest.Entry},
+	}
+	for _, field := range fields {
+		if field[1] != "" {
+			fmt.Fprintf(&b, "\t%s: %s\n", field[0], quoteManifest(field[1]))
+		}
+	}
+	if len(manifest.Dependencies) > 0 {
+		quoted := make([]string, len(manifest.Dependencies))
+		for i, dependency := range manifest.Dependencies {
+			quoted[i] = quoteManifest(dependency)
+		}
+		fmt.Fprintf(&b, "\tdependencies: [%s]\n", strings.Join(quoted, ", "))
+	}
+	if len(manifest.Packages) > 0 {
+		b.WriteString("\tpackages: {\n")
+		for _, pkg := range manifest.Packages {
+			name := pkg.Name
+			if !manifestIdent.MatchString(name) {
+				name = quoteManifest(name)
+			}
+			fmt.Fprintf(&b, "\t\t%s: %s\n", name, quoteManifest(pkg.Source))
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// DependencyDirs are the directories of the manifest's dependencies,
+// resolved against the directory of the tsh.mod.
+func (manifest *Manifest) DependencyDirs() []string {
+	root := filepath.Dir(manifest.Path)
+	dirs := []string{}
+	for _, dependency := range manifest.Dependencies {
+		if filepath.IsAbs(dependency) {
+			dirs = append(dirs, dependency)
+		} else {
+			dirs = append(dirs, filepath.Join(root, dependency))
+		}
+	}
+	return dirs
+}
+
+// FindProject looks for a tsh.mod at or above dir and returns the
+// directory holding it.
+func FindProject(dir string) (string, bool) {
+	start, err := filepath.Abs(dir)
+	if err != nil {
+		return dir, false
+	}
+	for dir := start; ; {
+		if _, err := os.Stat(filepath.Join(dir, ManifestFile)); err == nil {
+			return dir, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return start, false
+		}
+		dir = parent
+	}
+}
+
+// DirChecksum hashes the names and contents of every file below dir,
+// skipping hidden files, so a dependency that changes is noticed.
+func DirChecksum(dir string) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", filepath.ToSlash(rel), len(content))
+		hash.Write(content)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// LockEntry pins a dependency, as written in tsh.mod, to a checksum
+// of its files.
+type LockEntry struct {
+	Name string
+	Sum string
+}
+
+// ReadLock reads a tsh.lock: one "name checksum" pair per line.
+func ReadLock(path string) ([]LockEntry, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := []LockEntry{}
+	for i, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name and a checksum", path, i+1)
+		}
+		entries = append(entries, LockEntry{Name: fields[0], Sum: fields[1]})
+	}
+	return entries, nil
+}
+
+func WriteLock(path string, entries []LockEntry) error {
+	var b strings.Builder
+	b.WriteString("# Generated by tsh, do not edit.\n")
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%s %s\n", entry.Name, entry.Sum)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// LockedSum returns the checksum tsh.lock holds for name, if any.
+func LockedSum(manifest *Manifest, name string) (string, bool) {
+	locked, err := ReadLock(filepath.Join(filepath.Dir(manifest.Path), LockFile))
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range locked {
+		if entry.Name == name {
+			return entry.Sum, true
+		}
+	}
+	return "", false
+}
+
+// LockEntries computes the lock of the manifest's dependencies as
+// they are on disk now.
+func LockEntries(manifest *Manifest) ([]LockEntry, error) {
+	entries := []LockEntry{}
+	for i, dir := range manifest.DependencyDirs() {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("dependency '%s' is not a directory", manifest.Dependencies[i])
+		}
+		sum, err := DirChecksum(dir)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, LockEntry{Name: manifest.Dependencies[i], Sum: sum})
+	}
+	for _, pkg := range manifest.Packages {
+		dir := filepath.Join(filepath.Dir(manifest.Path), ModulesDir, pkg.Name)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("package '%s' is not installed, run 'tsh get'", pkg.Name)
+		}
+		sum, err := DirChecksum(dir)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, LockEntry{Name: ModulesDir + "/" + pkg.Name, Sum: sum})
+	}
+	return entries, nil
+}
+
+// CheckLock compares the dependencies with tsh.lock. A dependency
+// whose files changed since it was locked is an error; dependencies
+// added to or dropped from tsh.mod just update the lock.
+func CheckLock(manifest *Manifest) error {
+	entries, err := LockEntries(manifest)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(filepath.Dir(manifest.Path), LockFile)
+	locked, err := ReadLock(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	sums := map[string]string{}
+	for _, entry := range locked {
+		sums[entry.Name] = entry.Sum
+	}
+	for _, entry := range entries {
+		if sum, ok := sums[entry.Name]; ok && sum != entry.Sum {
+			return fmt.Errorf("dependency '%s' does not match %s, run 'tsh lock' if the change is expected", entry.Name, LockFile)
+		}
+	}
+	if err == nil && reflect.DeepEqual(locked, entries) || err != nil && len(entries) == 0 {
+		return nil
+	}
+	return WriteLock(path, entries)
+}
+
+// ReadProject reads the manifest of the project at or above dir. It
+// returns nil when there is no tsh.mod, and an error with a nil
+// manifest for a broken one.
+func ReadProject(dir string) (*Manifest, error) {
+	root, ok := FindProject(dir)
+	if !ok {
+		return nil, nil
+	}
+	manifest, err := ParseManifest(filepath.Join(root, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// LoadProject is ReadProject for the project commands, which exit on
+// a broken tsh.mod.
+func LoadProject(dir string) *Manifest {
+	manifest, err := ReadProject(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+		Exit(ExitConfig)
+	}
+	return manifest
+}
+
+// InitCommand implements 'tsh init [name]': a tsh.mod and a main.t#
+// in the working directory.
+func InitCommand(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: tsh init [name]")
+		return ExitUsage
+	}
+	if _, err := os.Stat(ManifestFile); err == nil {
+		fmt.Fprintln(os.Stderr, "Error: " + ManifestFile + " already exists")
+		return ExitUsage
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+		return ExitRuntimeError
+	}
+	manifest := &Manifest{Name: filepath.Base(wd), Version: "0.1.0", Entry: "main.t#"}
+	if len(args) == 1 {
+		manifest.Name = args[0]
+	}
+	if err := os.WriteFile(ManifestFile, []byte(manifest.String()), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+		return ExitRuntimeError
+	}
+	fmt.Fprintln(Out, "created " + ManifestFile)
+	if _, err := os.Stat(manifest.Entry); err != nil {
+		if err := os.WriteFile(manifest.Entry, []byte("\"Hello World\" print\n"), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+			return ExitRuntimeError
+		}
+		fmt.Fprintln(Out, "created " + manifest.Entry)
+	}
+	return ExitOK
+}
+
+// RunEntryCommand implements 'tsh run': the entry of the project in the
+// working directory, after checking its dependencies against tsh.lock.
+func RunEntryCommand(args []string) int {
+	flags:
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+			case "--sandbox":
+				Sandbox = true
+			case "--":
+				args = args[1:]
+				break flags
+			default:
+				fmt.Fprintln(os.Stderr, "Error: unknown flag '" + args[0] + "'")
+				return ExitUsage
+		}
+		args = args[1:]
+	}
+	manifest := LoadProject(".")
+	if manifest == nil {
+		fmt.Fprintln(os.Stderr, "Error: no " + ManifestFile + " found, run 'tsh init' to create one")
+		return ExitNoInput
+	}
+	if manifest.Entry == "" {
+		fmt.Fprintln(os.Stderr, "Error: " + manifest.Path + " has no 'entry'")
+		return ExitConfig
+	}
+	if err := CheckLock(manifest); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+		return ExitConfig
+	}
+	Args = args
+	RunScript(filepath.Join(filepath.Dir(manifest.Path), manifest.Entry))
+	return ExitOK
+}
+
+// ModulesDir is where 'tsh get' installs packages, below the project
+// root. 'import "greet/hello"' finds tsh_modules/greet/hello.t#.
+const ModulesDir = "tsh_modules"
+
+// IsGitSource reports whether a package source is fetched with git:
+// anything that is not a plain local directory, including a local
+// bare repository.
+func IsGitSource(source string) bool {
+	info, err := os.Stat(source)
+	if err != nil || !info.IsDir() {
+		return true
+	}
+	_, head := os.Stat(filepath.Join(source, "HEAD"))
+	_, objects := os.Stat(filepath.Join(source, "objects"))
+	return head == nil && objects == nil
+}
+
+// CopyDir copies the files below src to dst, skipping hidden ones as
+// DirChecksum does.
+func CopyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if path != src && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, info.Mode().Perm())
+	})
+}
+
+// FetchPackage puts a copy of source at dir, cloning it with git when
+// it is not a plain directory. Git metadata is not kept.
+func FetchPackage(source string, dir string) error {
+	if !IsGitSource(source) {
+		return CopyDir(source, dir)
+	}
+	cmd := exec.Command("git", "clone", "--quiet", "--", source, dir)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git clone '%s' failed: %s", source, err)
+	}
+	return os.RemoveAll(filepath.Join(dir, ".git"))
+}
+
+// PackageName is the name a fetched package is installed under: the
+// name in its own tsh.mod, or else the last element of its source.
+func PackageName(dir string, source string) string {
+	if manifest, err := ParseManifest(filepath.Join(dir, ManifestFile)); err == nil {
+		name := manifest.Name
+		if name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\") {
+			return name
+		}
+	}
+	name := strings.TrimSuffix(strings.TrimRight(filepath.ToSlash(source), "/"), ".git")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// InstallPackage fetches source into tsh_modules/ of the project and
+// returns the name it was installed under. Unless update is set, the
+// files must match the checksum tsh.lock holds for that name.
+func InstallPackage(manifest *Manifest, source string, update bool) (string, error) {
+	root := filepath.Dir(manifest.Path)
+	modules := filepath.Join(root, ModulesDir)
+	if err := os.MkdirAll(modules, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(modules, ".get-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	fetched := filepath.Join(tmp, "package")
+	if err := FetchPackage(source, fetched); err != nil {
+		return "", err
+	}
+	name := PackageName(fetched, source)
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("cannot tell the name of the package at '%s'", source)
+	}
+	sum, err := DirChecksum(fetched)
+	if err != nil {
+		return "", err
+	}
+	if locked, ok := LockedSum(manifest, ModulesDir + "/" + name); ok && locked != sum && !update {
+		return "", fmt.Errorf("package '%s' from '%s' does not match %s, run 'tsh get --update' to accept it", name, source, LockFile)
+	}
+	dir := filepath.Join(modules, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	return name, os.Rename(fetched, dir)
+}
+
+// GetCommand implements 'tsh get': each source is installed under
+// tsh_modules/ and recorded in tsh.mod and tsh.lock. With no source,
+// the packages tsh.mod lists are installed as tsh.lock pins them.
+func GetCommand(args []string) int {
+	update := false
+	if len(args) > 0 && args[0] == "--update" {
+		update = true
+		args = args[1:]
+	}
+	for _, source := range args {
+		if strings.HasPrefix(source, "-") {
+			fmt.Fprintln(os.Stderr, "Error: unknown option '" + source + "'")
+			return ExitUsage
+		}
+	}
+	manifest := LoadProject(".")
+	if manifest == nil {
+		fmt.Fprintln(os.Stderr, "Error: no " + ManifestFile + " found, run 'tsh init' to create one")
+		return ExitNoInput
+	}
+	root := filepath.Dir(manifest.Path)
+	fail := func(err error) int {
+		Out.Flush()
+		fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+		return ExitRuntimeError
+	}
+	if len(args) == 0 {
+		for _, pkg := range manifest.Packages {
+			source := pkg.Source
+			if !filepath.IsAbs(source) && !strings.Contains(source, ":") {
+				source = filepath.Join(root, source)
+			}
+			name, err := InstallPackage(manifest, source, update)
+			if err != nil {
+				return fail(err)
+			}
+			if name != pkg.Name {
+				return fail(fmt.Errorf("package '%s' from '%s' is now named '%s'", pkg.Name, pkg.Source, name))
+			}
+			fmt.Fprintln(Out, "installed " + name)
+		}
+	}
+	for _, source := range args {
+		name, err := InstallPackage(manifest, source, update)
+		if err != nil {
+			return fail(err)
+		}
+		// a local source is recorded relative to the project, so the
+		// project still works when it is moved or cloned elsewhere
+		recorded := source
+		if _, err := os.Stat(source); err == nil && !filepath.IsAbs(source) {
+			if abs, err := filepath.Abs(source); err == nil {
+				if rel, err := filepath.Rel(root, abs); err == nil {
+					recorded = filepath.ToSlash(rel)
+				}
+			}
+		}
+		found := false
+		for i := range manifest.Packages {
+			if manifest.Packages[i].Name == name {
+				manifest.Packages[i].Source = recorded
+				found = true
+			}
+		}
+		if !found {
+			manifest.Packages = append(manifest.Packages, Package{Name: name, Source: recorded})
+		}
+		fmt.Fprintln(Out, "installed " + name)
+	}
+	if len(args) > 0 {
+		if err := os.WriteFile(manifest.Path, []byte(manifest.String()), 0644); err != nil {
+			return fail(err)
+		}
+	}
+	entries, err := LockEntries(manifest)
+	if err != nil {
+		return fail(err)
+	}
+	if err := WriteLock(filepath.Join(root, LockFile), entries); err != nil {
+		return fail(err)
+	}
+	return ExitOK
+}
+
+// LockCommand implements 'tsh lock': tsh.lock rewritten from the
+// dependencies as they are now.
+func LockCommand(args []string) int {
+	manifest := LoadProject(".")
+	if manifest == nil {
+		fmt.Fprintln(os.Stderr, "Error: no " + ManifestFile + " found")
+		return ExitNoInput
+	}
+	entries, err := LockEntries(manifest)
+	if err == nil {
+		err = WriteLock(filepath.Join(filepath.Dir(manifest.Path), LockFile), entries)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: " + err.Error())
+		return ExitConfig
+	}
+	return ExitOK
+}
+
+
+// -----------------------------
+// ----------- Main ------------
+// -----------------------------
+
+func Usage(code int) {
+	fmt.Println("Usage:")
+	fmt.Println("  tsh [flags] <filename>.t# [--] [arguments]")
+	fmt.Println()
+	fmt.Println("Flags:")
+	fmt.Println("  -h, --help    show this help")
+	fmt.Println("  --sandbox     do not let the script run other programs")
+	fmt.Println()
+	fmt.Println("Everything after the file name is passed to the script, see 'args'.")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  tsh init [name]             create a tsh.mod and main.t# here")
+	fmt.Println("  tsh run [--sandbox] [args]  run the entry of the project in tsh.mod")
+	fmt.Println("  tsh lock                    record the dependencies' checksums in tsh.lock")
+	fmt.Println("  tsh get [--update] [src]... install packages from paths or git URLs")
+	fmt.Println("  tsh doc [module|file]...    print the documentation of modules as markdown")
+	fmt.Println("  tsh fmt [--check|--write] [file|dir]...")
+	fmt.Println("                              print, check or rewrite files in the canonical layout")
+	fmt.Println("  tsh lint [flags] [file|dir]...")
+	fmt.Println("                              report likely bugs, see 'tsh lint --rules'")
+	fmt.Println("  tsh lsp                     serve the Language Server Protocol on stdio")
+	fmt.Println("  tsh debug [flags] <filename>.t# [--] [arguments]")
+	fmt.Println("                              run a script in the step debugger, see 'help' at its prompt")
+	fmt.Println("  tsh dap                     serve the Debug Adapter Protocol on stdio")
+	os.Exit(code)
+}
+
+// Commands are the tools run as 'tsh <command>'. Each returns the
+// exit status.
+var Commands = map[string]func(args []string) int{
+	"doc": DocCommand,
+	"init": InitCommand,
+	"run": RunEntryCommand,
+	"lock": LockCommand,
+	"get": GetCommand,
+	"fmt": FmtCommand,
+	"lint": LintCommand,
+	"lsp": LspCommand,
+	"debug": DebugCommand,
+	"dap": DapCommand,
+}
+
+// Args are the command line arguments after the script name.
+var Args = []string{}
+
+func init() {
+	Builtins["args"] = func() {
+		list := []Expr{}
+		for _, arg := range Args {
+			list = append(list, Expr{Type: ExprStr, AsStr: arg})
+		}
+		PushList(list)
+	}
+	Builtins["getenv"] = func() { PushStr(os.Getenv(PopStr("getenv"))) }
+	Builtins["setenv"] = func() {
+		name, value := PopStr("setenv"), PopStr("setenv")
+		if err := os.Setenv(name, value); err != nil {
+			Raise("ValueError", fmt.Sprintf("cannot set environment variable '%s': %s", name, err))
+		}
+	}
+	Builtins["environ"] = func() {
+		environ := os.Environ()
+		sort.Strings(environ)
+		list := []Expr{}
+		for _, entry := range environ {
+			list = append(list, Expr{Type: ExprStr, AsStr: entry})
+		}
+		PushList(list)
+	}
+}
+
+// ParseArgs splits the command line into interpreter flags, the
+// script and the script's arguments. '--' ends the flags, and right
+// after the script name it is dropped so a script can take arguments
+// that look like flags.
+func ParseArgs(args []string) (string, []string) {
+	flags:
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+			case "-h", "--help":
+				Usage(ExitOK)
+			case "--sandbox":
+				Sandbox = true
+			case "--":
+				args = args[1:]
+				break flags
+			default:
+				fmt.Fprintln(os.Stderr, "Error: unknown flag '" + args[0] + "'")
+				Usage(ExitUsage)
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		Usage(ExitUsage)
+	}
+	if args[0] == "help" {
+		Usage(ExitOK)
+	}
+	scriptArgs := args[1:]
+	if len(scriptArgs) > 0 && scriptArgs[0] == "--" {
+		scriptArgs = scriptArgs[1:]
+	}
+	return args[0], scriptArgs
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := Commands[os.Args[1]]; ok {
+			Exit(command(os.Args[2:]))
+		}
+	}
+	var path string
+	path, Args = ParseArgs(os.Args[1:])
+	RunScript(path)
+}
+
+// RunScript runs the file at path as the main script.
+func RunScript(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Error: file '" + path + "' does not exist")
+
+		whilte := color.New(color.FgWhite)
+
+		fmt.Print("Run ")
+		boldWhite := whilte.Add(color.BgCyan)
+		boldWhite.Print(" tsh help ")
+		fmt.Println(" for usage")
+
+		os.Exit(ExitNoInput)
+	}
+
+	defer ReportUncaught()
+	VisitExpr(ParseScript(path, file))
+	Out.Flush()
+}
+
+// MainScript is the path of the script tsh was asked to run, as given.
+var MainScript string
+
+// ParseScript makes path the main script and parses it.
+func ParseScript(path string, file io.Reader) []Expr {
+	MainScript = path
+	if abs, err := filepath.Abs(path); err == nil {
+		CurrentModule.Path = abs
+		CurrentModule.Included[abs] = true
+		ImportChain = []string{abs}
+	}
+	InitSearchPath(path)
+	lexer := LexerInit(file)
+	parser := ParserInit(lexer)
+	parser.file = path
+	exprs, _ := ParserParse(parser)
+	return exprs
+}
+
+// Exit status of tsh. A script chooses its own with 'exit-with'.
+const (
+	ExitOK = 0
+	ExitRuntimeError = 1
+	ExitSyntaxError = 2
+	ExitUsage = 64
+	ExitNoInput = 66
+	ExitInternal = 70
+	ExitConfig = 78
+)
+
+// Exit flushes the program's output and ends the process.
+func Exit(code int) {
+	Out.Flush()
+	if Debug != nil && Debug.Exit != nil {
+		Debug.Exit(code)
+	}
+	os.Exit(code)
+}
+
+// OpExit ends the program. An int on top of the stack is popped and
+// used as the exit status.
+func OpExit() {
+	NotInEvaluation("exit")
+	Exit(ExitOK)
+}
+
+// OpExitWith ends the program with the status on top of the stack.
+func OpExitWith() {
+	NotInEvaluation("exit-with")
+	code := PopInt("exit-with")
+	if code < 0 || code > 255 {
+		Raise("ValueError", fmt.Sprintf("'exit-with' status %d is not between 0 and 255", code))
+	}
+	Exit(code)
+}
+
+// ReportUncaught prints an exception that reached main to standard
+// error and exits with ExitSyntaxError or ExitRuntimeError. Anything
+// else is a bug in tsh itself and exits with ExitInternal.
+func ReportUncaught() {
+	if r := recover(); r != nil {
+		Out.Flush()
+		if exception, ok := r.(*Exception); ok {
+			fmt.Fprintln(os.Stderr, exception.Error())
+			if exception.Kind == "SyntaxError" {
+				os.Exit(ExitSyntaxError)
+			}
+			os.Exit(ExitRuntimeError)
+		}
+		fmt.Fprintf(os.Stderr, "internal error: %v\n%s", r, debug.Stack())
+		os.Exit(ExitInternal)
+	}
 }
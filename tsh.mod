@@ -4,4 +4,5 @@ Module {
 	version: '0.0.0'
 	license: 'GPL-3.0'
 	repo_url: 'https://github.com/Tsharp-lang/Tsharp'
+	entry: 'examples/main.t#'
 }